@@ -0,0 +1,154 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// accountRegistrationTimeout is how long to wait for the reply to REGISTER and VERIFY commands.
+const accountRegistrationTimeout = 30 * time.Second
+
+var ErrAccountRegistrationUnsupported = errors.New("the network doesn't support account registration")
+
+// accountRegistrationReply is a successful reply to a REGISTER or VERIFY command
+// (https://ircv3.net/specs/extensions/account-registration).
+type accountRegistrationReply struct {
+	// Status is SUCCESS or VERIFICATION_REQUIRED
+	Status  string
+	Account string
+	Message string
+}
+
+// getAccountRegistrationCap returns the keys in the draft/account-registration cap value,
+// like email-required and custom-account-name.
+func (ic *IRCClient) getAccountRegistrationCap() ([]string, error) {
+	value, ok := ic.Conn.AcknowledgedCaps()["draft/account-registration"]
+	if !ok {
+		return nil, ErrAccountRegistrationUnsupported
+	}
+	return strings.Split(value, ","), nil
+}
+
+// RegisterAccount registers an account for the current nick. The account is logged in immediately
+// if the reply status is SUCCESS, otherwise it has to be verified with VerifyAccount first.
+func (ic *IRCClient) RegisterAccount(ctx context.Context, email, password string) (*accountRegistrationReply, error) {
+	flags, err := ic.getAccountRegistrationCap()
+	if err != nil {
+		return nil, err
+	} else if email == "" && slices.Contains(flags, "email-required") {
+		return nil, fmt.Errorf("the network requires an email address for registration")
+	}
+	if email == "" {
+		email = "*"
+	}
+	return ic.sendAccountCommand(ctx, "REGISTER", "*", email, password)
+}
+
+// VerifyAccount completes the registration of an account using the code the server sent to the user.
+func (ic *IRCClient) VerifyAccount(ctx context.Context, account, code string) (*accountRegistrationReply, error) {
+	return ic.sendAccountCommand(ctx, "VERIFY", account, code)
+}
+
+func parseAccountRegistrationReply(msg *ircmsg.Message) (*accountRegistrationReply, error) {
+	if msg.Command == "FAIL" {
+		return nil, makeStandardReplyError(msg)
+	} else if len(msg.Params) < 3 {
+		return nil, &IRCError{Msg: msg}
+	}
+	// REGISTER <SUCCESS|VERIFICATION_REQUIRED> <account> :<message>
+	return &accountRegistrationReply{
+		Status:  msg.Params[0],
+		Account: msg.Params[1],
+		Message: msg.Params[2],
+	}, nil
+}
+
+func (ic *IRCClient) sendAccountCommand(ctx context.Context, cmd string, args ...string) (*accountRegistrationReply, error) {
+	isReply := func(msg *ircmsg.Message) bool {
+		return msg.Command == cmd || (msg.Command == "FAIL" && len(msg.Params) > 0 && msg.Params[0] == cmd)
+	}
+	ctx, cancel := context.WithTimeout(ctx, accountRegistrationTimeout)
+	defer cancel()
+	resp, err := ic.getLabeledResponse(ctx, nil, cmd, args...)
+	if err == nil {
+		for _, msg := range flattenBatch(resp, nil) {
+			if isReply(&msg) {
+				return parseAccountRegistrationReply(&msg)
+			}
+		}
+		return nil, fmt.Errorf("no %s reply received", cmd)
+	} else if !errors.Is(err, ircevent.CapabilityNotNegotiated) {
+		return nil, err
+	}
+	result := make(chan *ircmsg.Message, 1)
+	ic.accountRegLock.Lock()
+	ic.accountRegResult = result
+	ic.accountRegLock.Unlock()
+	defer func() {
+		ic.accountRegLock.Lock()
+		ic.accountRegResult = nil
+		ic.accountRegLock.Unlock()
+	}()
+	err = ic.Conn.Send(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-result:
+		return parseAccountRegistrationReply(msg)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolveAccountRegistration passes replies to REGISTER and VERIFY to sendAccountCommand.
+// It returns true if the reply was consumed.
+func (ic *IRCClient) resolveAccountRegistration(msg ircmsg.Message) bool {
+	if len(msg.Params) == 0 {
+		return false
+	}
+	cmd := msg.Command
+	if cmd == "FAIL" {
+		cmd = msg.Params[0]
+	}
+	if cmd != "REGISTER" && cmd != "VERIFY" {
+		return false
+	}
+	ic.accountRegLock.Lock()
+	defer ic.accountRegLock.Unlock()
+	if ic.accountRegResult == nil {
+		return false
+	}
+	select {
+	case ic.accountRegResult <- &msg:
+	default:
+	}
+	return true
+}
+
+func (ic *IRCClient) onAccountRegistration(msg ircmsg.Message) {
+	ic.resolveAccountRegistration(msg)
+}
@@ -0,0 +1,222 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+)
+
+var ErrAccountNotOnline = errors.New("no user is currently logged into account")
+
+// useAccountGhosts returns true if logged-in users should be identified by their services account
+// rather than their nick. It requires the network to opt in and the server to support all the caps
+// that are needed to know the account of every user the bridge sees.
+func (ic *IRCClient) useAccountGhosts() bool {
+	if !ic.NetMeta.AccountGhosts {
+		return false
+	}
+	caps := ic.Conn.AcknowledgedCaps()
+	_, accountTag := caps["account-tag"]
+	_, extendedJoin := caps["extended-join"]
+	_, accountNotify := caps["account-notify"]
+	return accountTag && extendedJoin && accountNotify
+}
+
+// getAccount returns the services account that the given nick is logged into,
+// or an empty string if the user isn't logged in or the account is unknown.
+func (ic *IRCClient) getAccount(nick string) string {
+	user, _ := ic.getUser(nick)
+	return user.Account
+}
+
+// setAccount stores the account of the given nick and returns the previously stored account.
+// Empty strings and * mean the user isn't logged in.
+func (ic *IRCClient) setAccount(nick, account string) (prevAccount string) {
+	if account == "*" {
+		account = ""
+	}
+	ic.updateUser(nick, func(user *ircUser) bool {
+		prevAccount = user.Account
+		user.Account = account
+		return prevAccount != account
+	})
+	return
+}
+
+// findNickByAccount returns the nick that is currently logged into the given (casemapped) account.
+func (ic *IRCClient) findNickByAccount(mappedAccount string) (string, bool) {
+	ic.usersLock.RLock()
+	defer ic.usersLock.RUnlock()
+	for nick, user := range ic.users {
+		if user.Account != "" && ic.isupport.CaseMapping(user.Account) == mappedAccount {
+			return ic.casemappedNames.GetDefault(nick, nick), true
+		}
+	}
+	return "", false
+}
+
+// updateAccount stores the account of a user and swaps the ghost in all shared channels
+// if the change means the user is now represented by a different ghost.
+func (ic *IRCClient) updateAccount(msg ircmsg.Message, nick, account string) {
+	if account == "*" {
+		account = ""
+	}
+	prevAccount := ic.setAccount(nick, account)
+	if !ic.useAccountGhosts() || ic.isupport.CaseMapping(prevAccount) == ic.isupport.CaseMapping(account) {
+		return
+	}
+	prevSender := ic.makeGhostOnlyEventSender(nick)
+	prevSender.Sender = ic.makeUserIDWithAccount(nick, prevAccount)
+	newSender := ic.makeGhostOnlyEventSender(nick)
+	leaveReason, joinReason := "Logged out", "Logged out"
+	if account != "" {
+		leaveReason = fmt.Sprintf("Logged in as %s", account)
+		joinReason = leaveReason
+	}
+	ic.chatInfoCacheLock.RLock()
+	defer ic.chatInfoCacheLock.RUnlock()
+	for ch := range ic.unlockedFindChannelsOfMember(nick) {
+		if ic.isFetchingChannelAccounts(ch.Name) {
+			// The members haven't been synced yet, so the resync will use the right ghost
+			continue
+		}
+		ic.queueGhostSwap(msg, "account change", ch, prevSender, newSender, leaveReason, joinReason)
+	}
+}
+
+// fetchChannelAccounts sends a WHOX query for the accounts of all members of a channel.
+// The channel is resynced once the server has replied to the query.
+func (ic *IRCClient) fetchChannelAccounts(channel string, source ircmsg.Message) error {
+	key := ic.isupport.CaseMapping(channel)
+	ic.channelAccountQueriesLock.Lock()
+	ic.channelAccountQueries[key] = source
+	ic.channelAccountQueriesLock.Unlock()
+	err := ic.Conn.Send("WHO", channel, fmt.Sprintf("%s,%s", whoxFields, whoxToken))
+	if err != nil {
+		ic.channelAccountQueriesLock.Lock()
+		delete(ic.channelAccountQueries, key)
+		ic.channelAccountQueriesLock.Unlock()
+	}
+	return err
+}
+
+func (ic *IRCClient) isFetchingChannelAccounts(channel string) bool {
+	ic.channelAccountQueriesLock.Lock()
+	defer ic.channelAccountQueriesLock.Unlock()
+	_, ok := ic.channelAccountQueries[ic.isupport.CaseMapping(channel)]
+	return ok
+}
+
+func (ic *IRCClient) onEndOfWho(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	channel := msg.Params[1]
+	key := ic.isupport.CaseMapping(channel)
+	ic.channelAccountQueriesLock.Lock()
+	source, ok := ic.channelAccountQueries[key]
+	delete(ic.channelAccountQueries, key)
+	ic.channelAccountQueriesLock.Unlock()
+	if ok {
+		ic.queueChannelResync(source.Params[1], source)
+	}
+}
+
+func (ic *IRCClient) clearChannelAccountQueries() {
+	ic.channelAccountQueriesLock.Lock()
+	clear(ic.channelAccountQueries)
+	ic.channelAccountQueriesLock.Unlock()
+}
+
+// queueGhostSwap replaces one ghost with another in a channel, which is used
+// when the user ID of an IRC user changes (e.g. due to a nick or account change).
+func (ic *IRCClient) queueGhostSwap(
+	msg ircmsg.Message,
+	action string,
+	ch channelTuple,
+	prevSender, newSender bridgev2.EventSender,
+	leaveReason, joinReason string,
+) {
+	mm := bridgev2.ChatMemberMap{}
+	mm.Set(bridgev2.ChatMember{
+		EventSender: prevSender,
+		Membership:  event.MembershipLeave,
+		PowerLevel:  ptr.Ptr(0),
+		MemberEventExtra: map[string]any{
+			"reason": leaveReason,
+		},
+		PrevMembership: event.MembershipJoin,
+	})
+	mm.Set(bridgev2.ChatMember{
+		EventSender: newSender,
+		Membership:  event.MembershipJoin,
+		PowerLevel:  ptr.Ptr(ch.PowerLevel),
+		MemberEventExtra: map[string]any{
+			"reason": joinReason,
+		},
+	})
+	ic.UserLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventChatInfoChange,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("source", msg.Source).Str("action", action)
+			},
+			PortalKey: ic.makePortalKey(ch.Name),
+			Timestamp: getTimeTag(msg),
+		},
+		ChatInfoChange: &bridgev2.ChatInfoChange{
+			MemberChanges: &bridgev2.ChatMemberList{
+				MemberMap: mm,
+			},
+		},
+	})
+}
+
+// transferDMPortal moves the DM portal with a user to their new nick. This is only safe when the user
+// is logged into an account, as otherwise anyone could take the old nick to get access to the DM.
+// Existing DMs with the new nick are never overwritten.
+func (ic *IRCClient) transferDMPortal(ctx context.Context, prevNick, newNick string) {
+	log := zerolog.Ctx(ctx)
+	prevKey := ic.makePortalKey(prevNick)
+	newKey := ic.makePortalKey(newNick)
+	if prevKey == newKey {
+		return
+	}
+	existing, err := ic.Main.Bridge.GetExistingPortalByKey(ctx, newKey)
+	if err != nil {
+		log.Err(err).Msg("Failed to check if DM portal with new nick exists")
+		return
+	} else if existing != nil {
+		log.Debug().Msg("Not transferring DM portal as one already exists for the new nick")
+		return
+	}
+	result, _, err := ic.Main.Bridge.ReIDPortal(ctx, prevKey, newKey)
+	if err != nil {
+		log.Err(err).Msg("Failed to transfer DM portal to new nick")
+		return
+	}
+	log.Debug().Int("result", int(result)).Msg("Transferred DM portal to new nick")
+}
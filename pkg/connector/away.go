@@ -0,0 +1,180 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridgev2/matrix"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// preAwayUnspecified is the away message that tells servers supporting draft/pre-away that
+// the client is away without a specific reason. Bouncers use it to only mark the user as away
+// if all their other clients are away too.
+const preAwayUnspecified = "*"
+
+// setGhostPresence sets the Matrix presence of the ghost with the given ID if the ghost already exists.
+func (ic *IRCClient) setGhostPresence(userID networkid.UserID, presence event.Presence, statusMsg string) {
+	if !ic.Main.Config.Away.GhostPresence || userID == "" {
+		return
+	}
+	go func() {
+		log := ic.UserLogin.Log.With().
+			Str("action", "set ghost presence").
+			Str("ghost_id", string(userID)).
+			Logger()
+		ctx := log.WithContext(ic.Main.Bridge.BackgroundCtx)
+		ghost, err := ic.Main.Bridge.GetExistingGhostByID(ctx, userID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get ghost")
+			return
+		} else if ghost == nil {
+			return
+		}
+		asIntent, ok := ghost.Intent.(*matrix.ASIntent)
+		if !ok {
+			return
+		}
+		err = asIntent.Matrix.SetPresence(ctx, mautrix.ReqPresence{
+			Presence:  presence,
+			StatusMsg: statusMsg,
+		})
+		if err != nil {
+			log.Err(err).Msg("Failed to set presence")
+		}
+	}()
+}
+
+// updateGhostPresence sets the presence of a user's ghost based on their stored away status.
+func (ic *IRCClient) updateGhostPresence(nick string) {
+	user, _ := ic.getUser(nick)
+	if user.Away {
+		ic.setGhostPresence(ic.makeUserID(nick), event.PresenceUnavailable, user.AwayMessage)
+	} else {
+		ic.setGhostPresence(ic.makeUserID(nick), event.PresenceOnline, "")
+	}
+}
+
+// getOwnAwayMessage returns the away message to use when the user's Matrix presence isn't online.
+// An empty string means the user has disabled automatic away status.
+func (ic *IRCClient) getOwnAwayMessage(statusMsg string) string {
+	meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+	if meta.DisableAutoAway {
+		return ""
+	} else if statusMsg != "" {
+		return statusMsg
+	} else if meta.AwayMessage != "" {
+		return meta.AwayMessage
+	} else if _, preAway := ic.Conn.AcknowledgedCaps()["draft/pre-away"]; preAway {
+		return preAwayUnspecified
+	} else if ic.Main.Config.Away.DefaultMessage != "" {
+		return ic.Main.Config.Away.DefaultMessage
+	}
+	return "Away"
+}
+
+// setOwnPresence marks the user as away or back on IRC based on their Matrix presence.
+func (ic *IRCClient) setOwnPresence(ctx context.Context, presence *event.PresenceEventContent) {
+	var awayMessage string
+	if presence.Presence != event.PresenceOnline {
+		awayMessage = ic.getOwnAwayMessage(presence.StatusMessage)
+	}
+	ic.ownAwayLock.Lock()
+	defer ic.ownAwayLock.Unlock()
+	if ic.ownAwayMessage == awayMessage {
+		return
+	}
+	err := ic.sendAway(awayMessage)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to update away status")
+		return
+	}
+	ic.ownAwayMessage = awayMessage
+}
+
+// sendAway sends an AWAY command, or marks the user as back if the message is empty.
+func (ic *IRCClient) sendAway(message string) error {
+	if message == "" {
+		return ic.Conn.Send("AWAY")
+	}
+	return ic.Conn.Send("AWAY", message)
+}
+
+// onCapPreAway sends the stored away status as soon as the server acknowledges draft/pre-away.
+// This callback runs before irc-go's own CAP handler, so the AWAY is sent before CAP END
+// and the user is never seen as present while connecting.
+func (ic *IRCClient) onCapPreAway(msg ircmsg.Message) {
+	if len(msg.Params) < 3 || msg.Params[1] != "ACK" || ic.Conn.CurrentNick() != "" {
+		return
+	} else if !slices.Contains(strings.Fields(msg.Params[2]), "draft/pre-away") {
+		return
+	}
+	ic.ownAwayLock.Lock()
+	defer ic.ownAwayLock.Unlock()
+	if ic.ownAwayMessage == "" {
+		return
+	}
+	err := ic.sendAway(ic.ownAwayMessage)
+	if err != nil {
+		ic.UserLogin.Log.Err(err).Msg("Failed to send away status during registration")
+		return
+	}
+	ic.preAwaySent = true
+}
+
+// restoreOwnAway re-sends the away status after reconnecting, as servers forget it on disconnect.
+// Nothing is sent if the status was already set during registration using draft/pre-away.
+func (ic *IRCClient) restoreOwnAway() {
+	ic.ownAwayLock.Lock()
+	defer ic.ownAwayLock.Unlock()
+	preAwaySent := ic.preAwaySent
+	ic.preAwaySent = false
+	if ic.ownAwayMessage == "" || preAwaySent {
+		return
+	}
+	err := ic.sendAway(ic.ownAwayMessage)
+	if err != nil {
+		ic.UserLogin.Log.Err(err).Msg("Failed to restore away status")
+	}
+}
+
+func (ic *IRCConnector) handleMatrixPresence(ctx context.Context, evt *event.Event) {
+	if !ic.Config.Away.MatrixPresence || ic.Bridge.IsGhostMXID(evt.Sender) {
+		return
+	}
+	user, err := ic.Bridge.GetExistingUserByMXID(ctx, evt.Sender)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Stringer("user_id", evt.Sender).Msg("Failed to get user to handle presence")
+		return
+	} else if user == nil {
+		return
+	}
+	content := evt.Content.AsPresence()
+	for _, login := range user.GetCachedUserLogins() {
+		cli, ok := login.Client.(*IRCClient)
+		if ok && cli.IsLoggedIn() {
+			cli.setOwnPresence(login.Log.WithContext(ctx), content)
+		}
+	}
+}
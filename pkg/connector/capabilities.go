@@ -18,8 +18,10 @@ package connector
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 
-	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/event"
 )
@@ -33,10 +35,16 @@ var genCaps = &bridgev2.NetworkGeneralCapabilities{
 		ResolveIdentifier: bridgev2.ResolveIdentifierCapabilities{
 			CreateDM:       true,
 			LookupUsername: true,
-			ContactList:    false,
-			Search:         false,
+			ContactList:    true,
+			Search:         true,
+		},
+		GroupCreation: map[string]bridgev2.GroupTypeCapabilities{
+			"channel": {
+				TypeDescription: "channel",
+				Name:            bridgev2.GroupFieldCapability{Allowed: true, Required: true},
+				Topic:           bridgev2.GroupFieldCapability{Allowed: true},
+			},
 		},
-		GroupCreation: nil,
 	},
 }
 
@@ -44,8 +52,10 @@ func (ic *IRCConnector) GetCapabilities() *bridgev2.NetworkGeneralCapabilities {
 	return genCaps
 }
 
-var caps = &event.RoomFeatures{
-	ID: "fi.mau.irc.capabilities.2025_11_10",
+const capIDPrefix = "fi.mau.irc.capabilities.2025_11_10"
+
+// baseCaps contains the room features that don't depend on what the server supports.
+var baseCaps = &event.RoomFeatures{
 	File: map[event.CapabilityMsgType]*event.FileFeatures{
 		event.MsgImage: {
 			MimeTypes:        map[string]event.CapabilitySupportLevel{"*/*": event.CapLevelFullySupported},
@@ -78,20 +88,70 @@ var caps = &event.RoomFeatures{
 			MaxCaptionLength: 400,
 		},
 	},
-	Reply:         event.CapLevelPartialSupport,
-	MaxTextLength: 500,
 }
 
-var relayCaps = ptr.Clone(caps)
+// roomFeaturesKey contains the per-portal inputs for room features.
+// Everything else is derived from the connection, so the cache is reset when reconnecting.
+type roomFeaturesKey struct {
+	relay         bool
+	maxTextLength int
+}
+
+func (ic *IRCClient) buildRoomFeatures(key roomFeaturesKey) *event.RoomFeatures {
+	ackedCaps := ic.Conn.AcknowledgedCaps()
+	_, hasTags := ackedCaps["message-tags"]
+	_, hasRedaction := ackedCaps["draft/message-redaction"]
+	features := baseCaps.Clone()
+	features.MaxTextLength = key.maxTextLength
+	features.PerMessageProfileRelay = key.relay
+	features.Reply = event.CapLevelDropped
+	features.Reaction = event.CapLevelRejected
+	features.Delete = event.CapLevelRejected
+	if hasTags && ic.isupport.ClientTagAllowed("draft/reply") {
+		features.Reply = event.CapLevelPartialSupport
+		if ic.isupport.ClientTagAllowed("draft/react") {
+			features.Reaction = event.CapLevelFullySupported
+		}
+	}
+	if hasRedaction {
+		features.Delete = event.CapLevelFullySupported
+	}
+	features.TypingNotifications = hasTags && ic.isupport.ClientTagAllowed("typing")
+	// PerMessageProfileRelay isn't included in the hash, so add it separately
+	hashInput := features.Hash()
+	if key.relay {
+		hashInput = append(hashInput, "relay"...)
+	}
+	hash := sha256.Sum256(hashInput)
+	features.ID = fmt.Sprintf("%s+%s", capIDPrefix, base64.RawURLEncoding.EncodeToString(hash[:12]))
+	return features
+}
 
-func init() {
-	relayCaps.PerMessageProfileRelay = true
+func (ic *IRCClient) resetRoomFeatures() {
+	ic.roomFeaturesLock.Lock()
+	clear(ic.roomFeatures)
+	ic.roomFeaturesLock.Unlock()
 }
 
 func (ic *IRCClient) GetCapabilities(ctx context.Context, portal *bridgev2.Portal) *event.RoomFeatures {
-	_, canRelay := ic.Conn.AcknowledgedCaps()["draft/relaymsg"]
-	if canRelay {
-		return relayCaps
+	if channel, err := ic.parsePortalID(portal.ID); err == nil && channel == statusChannel {
+		return statusRoomFeatures
+	}
+	var key roomFeaturesKey
+	_, key.relay = ic.Conn.AcknowledgedCaps()["draft/relaymsg"]
+	if limits := ic.getMultilineLimits(); limits != nil {
+		key.maxTextLength = limits.MaxBytes
+	} else if channel, err := ic.parsePortalID(portal.ID); err == nil {
+		key.maxTextLength = ic.maxMessageLength(ic.Conn.CurrentNick(), "PRIVMSG", channel)
+	} else {
+		key.maxTextLength = 400
+	}
+	ic.roomFeaturesLock.Lock()
+	defer ic.roomFeaturesLock.Unlock()
+	features, ok := ic.roomFeatures[key]
+	if !ok {
+		features = ic.buildRoomFeatures(key)
+		ic.roomFeatures[key] = features
 	}
-	return caps
+	return features
 }
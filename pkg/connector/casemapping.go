@@ -0,0 +1,230 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
+)
+
+// getInitialISupport returns the ISUPPORT values to use before connecting, which only consist of
+// the casemapping that the network had last time, so that IDs don't change before ISUPPORT is received.
+func (ic *IRCConnector) getInitialISupport(ctx context.Context, netName string) *ISupport {
+	casemapping, err := ic.DB.GetCasemapping(ctx, netName)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Str("network", netName).Msg("Failed to get stored casemapping")
+	}
+	return casemappingISupport(casemapping)
+}
+
+func casemappingISupport(casemapping string) *ISupport {
+	if casemapping == "" {
+		return defaultISupport
+	}
+	return ParseISupport(map[string]string{"CASEMAPPING": casemapping})
+}
+
+// migrateCasemapping re-keys portals of the network if the casemapping changed since the last time
+// the network was connected to, and moves the room memberships of ghosts whose IDs changed to the new ghosts.
+// Portals whose new ID already exists are merged by the bridge.
+//
+// This does a lot of requests, so it must not be called from the IRC read loop.
+func (ic *IRCClient) migrateCasemapping(ctx context.Context) {
+	ic.Main.casemapMigrationLock.Lock()
+	defer ic.Main.casemapMigrationLock.Unlock()
+	log := zerolog.Ctx(ctx).With().Str("action", "migrate casemapping").Logger()
+	ctx = log.WithContext(ctx)
+	newCasemapping := ic.isupport.CaseMappingName
+	oldCasemapping, err := ic.Main.DB.GetCasemapping(ctx, ic.NetMeta.Name)
+	if err != nil {
+		log.Err(err).Msg("Failed to get stored casemapping")
+		return
+	} else if oldCasemapping == newCasemapping {
+		return
+	}
+	log.Info().
+		Str("old_casemapping", oldCasemapping).
+		Str("new_casemapping", newCasemapping).
+		Msg("Network casemapping changed, migrating portal and ghost IDs")
+	err = ic.migrateCasemappingPortals(ctx, casemappingISupport(oldCasemapping))
+	if err != nil {
+		log.Err(err).Msg("Failed to migrate portal IDs")
+		return
+	}
+	err = ic.Main.DB.SetCasemapping(ctx, ic.NetMeta.Name, newCasemapping)
+	if err != nil {
+		log.Err(err).Msg("Failed to save new casemapping")
+	}
+}
+
+// remapName returns the name that was folded with the old casemapping folded with the current one instead.
+// Folding can't be undone, so the original name is taken from the given candidates (like the portal or
+// ghost name) or the names seen on this connection. The folded name is only re-folded if none of them match,
+// which is wrong if the old casemapping folded more characters than the new one.
+func (ic *IRCClient) remapName(oldISupport *ISupport, folded string, candidates ...string) string {
+	if cached, ok := ic.casemappedNames.Get(folded); ok {
+		candidates = append(candidates, cached)
+	}
+	for _, name := range candidates {
+		if name != "" && oldISupport.CaseMapping(name) == folded {
+			return ic.isupport.CaseMapping(name)
+		}
+	}
+	return ic.isupport.CaseMapping(folded)
+}
+
+// remapUserID returns the ID that the given ghost has with the current casemapping,
+// or an empty string if the ghost is from another network or its ID doesn't change.
+func (ic *IRCClient) remapUserID(oldISupport *ISupport, userID networkid.UserID, ghostName string) networkid.UserID {
+	netName, name, err := parseUserID(userID)
+	if err != nil || netName != ic.NetMeta.Name {
+		return ""
+	}
+	var mappedName string
+	if account, isAccount := strings.CutPrefix(name, accountIDPrefix); isAccount {
+		// The ghost name is a nick, so it can't be used to find the original account name
+		mappedName = accountIDPrefix + ic.remapName(oldISupport, account)
+	} else {
+		mappedName = ic.remapName(oldISupport, name, ghostName)
+	}
+	if mappedName == name {
+		return ""
+	}
+	return networkid.UserID(fmt.Sprintf("%s_%s", netName, mappedName))
+}
+
+func (ic *IRCClient) migrateCasemappingPortals(ctx context.Context, oldISupport *ISupport) error {
+	dbPortals, err := ic.Main.Bridge.DB.Portal.GetAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get portals: %w", err)
+	}
+	for _, dbPortal := range dbPortals {
+		netName, channel, err := parsePortalID(dbPortal.ID)
+		if err != nil || netName != ic.NetMeta.Name {
+			continue
+		}
+		// DM portals don't have a name, but the other user's ghost has the original nick
+		var otherGhostName string
+		if dbPortal.OtherUserID != "" {
+			otherGhost, err := ic.Main.Bridge.GetExistingGhostByID(ctx, dbPortal.OtherUserID)
+			if err != nil {
+				return fmt.Errorf("failed to get ghost %s: %w", dbPortal.OtherUserID, err)
+			} else if otherGhost != nil {
+				otherGhostName = otherGhost.Name
+			}
+		}
+		var portal *bridgev2.Portal
+		if mappedChannel := ic.remapName(oldISupport, channel, dbPortal.Name, otherGhostName); mappedChannel != channel {
+			newKey := networkid.PortalKey{
+				ID:       networkid.PortalID(fmt.Sprintf("%s:%s", netName, mappedChannel)),
+				Receiver: dbPortal.Receiver,
+			}
+			var result bridgev2.ReIDResult
+			result, portal, err = ic.Main.Bridge.ReIDPortal(ctx, dbPortal.PortalKey, newKey)
+			if err != nil {
+				return fmt.Errorf("failed to re-ID portal %s: %w", dbPortal.ID, err)
+			}
+			zerolog.Ctx(ctx).Debug().
+				Str("old_id", string(dbPortal.ID)).
+				Str("new_id", string(newKey.ID)).
+				Int("result", int(result)).
+				Msg("Re-IDed portal")
+		} else {
+			portal, err = ic.Main.Bridge.GetExistingPortalByKey(ctx, dbPortal.PortalKey)
+			if err != nil {
+				return fmt.Errorf("failed to get portal %s: %w", dbPortal.ID, err)
+			}
+		}
+		if portal == nil {
+			continue
+		}
+		if newOtherUserID := ic.remapUserID(oldISupport, portal.OtherUserID, otherGhostName); newOtherUserID != "" {
+			portal.OtherUserID = newOtherUserID
+			err = portal.Save(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to save portal %s: %w", portal.ID, err)
+			}
+		}
+		if portal.MXID != "" {
+			err = ic.migrateCasemappingGhosts(ctx, portal, oldISupport)
+			if err != nil {
+				return fmt.Errorf("failed to migrate ghosts in %s: %w", portal.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateCasemappingGhosts replaces ghosts in the room whose IDs changed with the new ghosts.
+// The old ghosts are left in the database, as they're still the senders of old messages.
+func (ic *IRCClient) migrateCasemappingGhosts(ctx context.Context, portal *bridgev2.Portal, oldISupport *ISupport) error {
+	members, err := ic.Main.Bridge.Matrix.GetMembers(ctx, portal.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to get members: %w", err)
+	}
+	for userID, member := range members {
+		if member.Membership != event.MembershipJoin {
+			continue
+		}
+		oldGhost, err := ic.Main.Bridge.GetGhostByMXID(ctx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get ghost %s: %w", userID, err)
+		} else if oldGhost == nil {
+			continue
+		}
+		newID := ic.remapUserID(oldISupport, oldGhost.ID, oldGhost.Name)
+		if newID == "" {
+			continue
+		}
+		newGhost, err := ic.Main.Bridge.GetGhostByID(ctx, newID)
+		if err != nil {
+			return fmt.Errorf("failed to get ghost %s: %w", newID, err)
+		}
+		if newGhost.Name == "" && oldGhost.Name != "" {
+			newGhost.UpdateInfo(ctx, &bridgev2.UserInfo{Name: &oldGhost.Name})
+		}
+		err = newGhost.Intent.EnsureJoined(ctx, portal.MXID)
+		if err != nil {
+			return fmt.Errorf("failed to join %s to room: %w", newID, err)
+		}
+		_, err = oldGhost.Intent.SendState(ctx, portal.MXID, event.StateMember, userID.String(), &event.Content{
+			Parsed: &event.MemberEventContent{
+				Membership: event.MembershipLeave,
+				Reason:     "Network casemapping changed",
+			},
+		}, time.Time{})
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).
+				Stringer("user_id", userID).
+				Stringer("room_id", portal.MXID).
+				Msg("Failed to remove old ghost from room")
+		}
+		zerolog.Ctx(ctx).Debug().
+			Str("old_id", string(oldGhost.ID)).
+			Str("new_id", string(newID)).
+			Stringer("room_id", portal.MXID).
+			Msg("Moved ghost membership after casemapping change")
+	}
+	return nil
+}
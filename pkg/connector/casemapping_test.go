@@ -0,0 +1,65 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"testing"
+
+	"go.mau.fi/util/exsync"
+)
+
+func newCasemappingTestClient(casemapping string) *IRCClient {
+	return &IRCClient{
+		NetMeta:         &NetworkConfig{Name: "test"},
+		isupport:        casemappingISupport(casemapping),
+		casemappedNames: exsync.NewMap[string, string](),
+	}
+}
+
+func TestRemapName_RFC1459ToASCII(t *testing.T) {
+	ic := newCasemappingTestClient("ascii")
+	oldISupport := casemappingISupport("rfc1459")
+	folded := oldISupport.CaseMapping("#Foo[x]")
+	if folded != "#foo{x}" {
+		t.Fatalf("Unexpected rfc1459 folding %q", folded)
+	}
+	if remapped := ic.remapName(oldISupport, folded, "#Foo[x]"); remapped != "#foo[x]" {
+		t.Errorf("Expected #foo[x] from portal name, got %q", remapped)
+	}
+	if remapped := ic.remapName(oldISupport, folded, "#Other"); remapped != "#foo{x}" {
+		t.Errorf("Expected non-matching candidate to be ignored, got %q", remapped)
+	}
+	ic.casemappedNames.Set(folded, "#FOO[x]")
+	if remapped := ic.remapName(oldISupport, folded); remapped != "#foo[x]" {
+		t.Errorf("Expected #foo[x] from cached name, got %q", remapped)
+	}
+}
+
+func TestRemapUserID_RFC1459ToASCII(t *testing.T) {
+	ic := newCasemappingTestClient("ascii")
+	oldISupport := casemappingISupport("rfc1459")
+	newID := ic.remapUserID(oldISupport, "test_nick{away}", "Nick[away]")
+	if newID != "test_nick[away]" {
+		t.Errorf("Expected test_nick[away], got %q", newID)
+	}
+	if newID = ic.remapUserID(oldISupport, "test_nick", "Nick"); newID != "" {
+		t.Errorf("Expected unchanged ID to return empty string, got %q", newID)
+	}
+	if newID = ic.remapUserID(oldISupport, "other_nick{away}", "Nick[away]"); newID != "" {
+		t.Errorf("Expected ghost from other network to be skipped, got %q", newID)
+	}
+}
@@ -0,0 +1,332 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+
+	"go.mau.fi/mautrix-irc/pkg/ircfmt"
+)
+
+const (
+	// channelListCacheTTL is how long LIST results are reused before asking the server again.
+	channelListCacheTTL = 10 * time.Minute
+	// channelListTimeout is how long to wait for the server to finish sending the channel list.
+	// It's relatively long, as the full list of big networks can have tens of thousands of channels.
+	channelListTimeout = 60 * time.Second
+)
+
+var (
+	ErrChannelListTryAgain   = errors.New("the server is too busy to list channels, try again later")
+	ErrChannelListInProgress = errors.New("another channel list is already being fetched, try again later")
+)
+
+type channelListEntry struct {
+	Name  string
+	Users int
+	Topic string
+}
+
+type cachedChannelList struct {
+	Entries   []channelListEntry
+	FetchedAt time.Time
+}
+
+// channelListFilter contains the conditions for filtering the channel list.
+// Masks are OR'd together, everything else must match.
+type channelListFilter struct {
+	Masks    []string
+	NotMasks []string
+	// MinUsers and MaxUsers are exclusive like in ELIST, -1 means unset.
+	MinUsers int
+	MaxUsers int
+}
+
+func parseChannelListFilter(args []string, chanTypes string) *channelListFilter {
+	filter := &channelListFilter{MinUsers: -1, MaxUsers: -1}
+	for _, arg := range args {
+		if len(arg) > 1 && (arg[0] == '>' || arg[0] == '<') {
+			count, err := strconv.Atoi(arg[1:])
+			if err == nil && count >= 0 {
+				if arg[0] == '>' {
+					filter.MinUsers = count
+				} else {
+					filter.MaxUsers = count
+				}
+				continue
+			}
+		}
+		if len(arg) > 1 && arg[0] == '!' {
+			filter.NotMasks = append(filter.NotMasks, makeChannelMask(arg[1:], chanTypes))
+		} else {
+			filter.Masks = append(filter.Masks, makeChannelMask(arg, chanTypes))
+		}
+	}
+	return filter
+}
+
+// makeChannelMask turns plain search terms into a substring match. Channel names and anything with
+// wildcards are used as-is.
+func makeChannelMask(arg, chanTypes string) string {
+	if strings.ContainsAny(arg, "*?") || strings.IndexByte(chanTypes, arg[0]) >= 0 {
+		return arg
+	}
+	return fmt.Sprintf("*%s*", arg)
+}
+
+// ServerParam returns the parameter for the LIST command containing the conditions the server supports
+// based on the ELIST token. Conditions the server doesn't support are left out and have to be applied locally.
+func (f *channelListFilter) ServerParam(elist string) string {
+	var conditions []string
+	hasWildcards := slices.ContainsFunc(f.Masks, func(mask string) bool {
+		return strings.ContainsAny(mask, "*?")
+	})
+	// Masks are alternatives, so they can only be sent if the server can handle all of them
+	if len(f.Masks) > 0 && (!hasWildcards || strings.ContainsRune(elist, 'M')) {
+		conditions = append(conditions, f.Masks...)
+	}
+	if strings.ContainsRune(elist, 'N') {
+		for _, mask := range f.NotMasks {
+			conditions = append(conditions, "!"+mask)
+		}
+	}
+	if strings.ContainsRune(elist, 'U') {
+		if f.MinUsers >= 0 {
+			conditions = append(conditions, fmt.Sprintf(">%d", f.MinUsers))
+		}
+		if f.MaxUsers >= 0 {
+			conditions = append(conditions, fmt.Sprintf("<%d", f.MaxUsers))
+		}
+	}
+	return strings.Join(conditions, ",")
+}
+
+func (f *channelListFilter) Match(entry channelListEntry, casemap StringReplacer) bool {
+	if f.MinUsers >= 0 && entry.Users <= f.MinUsers {
+		return false
+	} else if f.MaxUsers >= 0 && entry.Users >= f.MaxUsers {
+		return false
+	}
+	name := casemap(entry.Name)
+	for _, mask := range f.NotMasks {
+		if matchMask(casemap(mask), name) {
+			return false
+		}
+	}
+	if len(f.Masks) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(f.Masks, func(mask string) bool {
+		return matchMask(casemap(mask), name)
+	})
+}
+
+// matchMask matches a string against an IRC mask where * matches any number of characters and ? matches one.
+func matchMask(mask, str string) bool {
+	var starMask, starStr int
+	star := false
+	maskIdx, strIdx := 0, 0
+	for strIdx < len(str) {
+		if maskIdx < len(mask) && (mask[maskIdx] == '?' || mask[maskIdx] == str[strIdx]) {
+			maskIdx++
+			strIdx++
+		} else if maskIdx < len(mask) && mask[maskIdx] == '*' {
+			star = true
+			starMask, starStr = maskIdx, strIdx
+			maskIdx++
+		} else if star {
+			starStr++
+			maskIdx, strIdx = starMask+1, starStr
+		} else {
+			return false
+		}
+	}
+	for maskIdx < len(mask) && mask[maskIdx] == '*' {
+		maskIdx++
+	}
+	return maskIdx == len(mask)
+}
+
+func parseListReply(msg ircmsg.Message) (channelListEntry, bool) {
+	// <client> <channel> <client count> :<topic>
+	if len(msg.Params) < 3 {
+		return channelListEntry{}, false
+	}
+	users, _ := strconv.Atoi(msg.Params[2])
+	entry := channelListEntry{Name: msg.Params[1], Users: users}
+	if len(msg.Params) >= 4 {
+		entry.Topic = ircfmt.StripASCII(msg.Params[3])
+	}
+	return entry, true
+}
+
+// listChannels returns the channels on the network matching the filter, sorted by user count.
+func (ic *IRCClient) listChannels(ctx context.Context, filter *channelListFilter) ([]channelListEntry, error) {
+	entries, err := ic.fetchChannelList(ctx, filter.ServerParam(ic.isupport.EList))
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]channelListEntry, 0, len(entries))
+	for _, entry := range entries {
+		if filter.Match(entry, ic.isupport.CaseMapping) {
+			filtered = append(filtered, entry)
+		}
+	}
+	slices.SortFunc(filtered, func(a, b channelListEntry) int {
+		return cmp.Or(cmp.Compare(b.Users, a.Users), cmp.Compare(a.Name, b.Name))
+	})
+	return filtered, nil
+}
+
+// fetchChannelList sends a LIST command with the given parameter, or returns the cached results
+// of an earlier identical command if they're fresh enough.
+func (ic *IRCClient) fetchChannelList(ctx context.Context, param string) ([]channelListEntry, error) {
+	ic.channelListLock.Lock()
+	cached, ok := ic.channelListCache[param]
+	ic.channelListLock.Unlock()
+	if ok && time.Since(cached.FetchedAt) < channelListCacheTTL {
+		return cached.Entries, nil
+	}
+	var args []string
+	if param != "" {
+		args = []string{param}
+	}
+	ctx, cancel := context.WithTimeout(ctx, channelListTimeout)
+	defer cancel()
+	var entries []channelListEntry
+	resp, err := ic.getLabeledResponse(ctx, nil, "LIST", args...)
+	if err == nil {
+		items := []*ircevent.Batch{resp}
+		if resp.Command == "BATCH" {
+			items = resp.Items
+		}
+		for _, item := range items {
+			switch item.Command {
+			case ircevent.RPL_LIST:
+				if entry, ok := parseListReply(item.Message); ok {
+					entries = append(entries, entry)
+				}
+			case "321", ircevent.RPL_LISTEND:
+				// 321 is RPL_LISTSTART, which most servers don't send anymore
+			case ircevent.RPL_TRYAGAIN:
+				return nil, ErrChannelListTryAgain
+			case "FAIL":
+				return nil, makeStandardReplyError(&item.Message)
+			default:
+				return nil, &IRCError{Msg: &item.Message}
+			}
+		}
+	} else if !errors.Is(err, ircevent.CapabilityNotNegotiated) {
+		return nil, err
+	} else {
+		entries, err = ic.collectChannelList(ctx, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ic.channelListLock.Lock()
+	ic.channelListCache[param] = &cachedChannelList{Entries: entries, FetchedAt: time.Now()}
+	ic.channelListLock.Unlock()
+	return entries, nil
+}
+
+// collectChannelList sends a LIST command and waits for the callbacks to receive all the replies.
+// This is used when the server doesn't support labeled responses. Replies can't be correlated
+// to commands without labels, so only one list can be collected at a time.
+func (ic *IRCClient) collectChannelList(ctx context.Context, args []string) ([]channelListEntry, error) {
+	done := make(chan struct{})
+	ic.channelListResultsLock.Lock()
+	if ic.channelListDone != nil {
+		ic.channelListResultsLock.Unlock()
+		return nil, ErrChannelListInProgress
+	}
+	ic.channelListResults, ic.channelListErr, ic.channelListDone = nil, nil, done
+	ic.channelListResultsLock.Unlock()
+	defer func() {
+		ic.channelListResultsLock.Lock()
+		ic.channelListResults, ic.channelListErr, ic.channelListDone = nil, nil, nil
+		ic.channelListResultsLock.Unlock()
+	}()
+	err := ic.Conn.Send("LIST", args...)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	ic.channelListResultsLock.Lock()
+	defer ic.channelListResultsLock.Unlock()
+	return ic.channelListResults, ic.channelListErr
+}
+
+func (ic *IRCClient) onList(msg ircmsg.Message) {
+	entry, ok := parseListReply(msg)
+	if !ok {
+		return
+	}
+	ic.channelListResultsLock.Lock()
+	defer ic.channelListResultsLock.Unlock()
+	if ic.unlockedIsCollectingChannelList() {
+		ic.channelListResults = append(ic.channelListResults, entry)
+	}
+}
+
+func (ic *IRCClient) onListEnd(msg ircmsg.Message) {
+	ic.finishChannelList(nil)
+}
+
+func (ic *IRCClient) onTryAgain(msg ircmsg.Message) {
+	// <client> <command> :Please wait a while and try again.
+	if len(msg.Params) >= 2 && strings.EqualFold(msg.Params[1], "LIST") {
+		ic.finishChannelList(ErrChannelListTryAgain)
+	}
+}
+
+func (ic *IRCClient) finishChannelList(err error) {
+	ic.channelListResultsLock.Lock()
+	defer ic.channelListResultsLock.Unlock()
+	if ic.unlockedIsCollectingChannelList() {
+		ic.channelListErr = err
+		close(ic.channelListDone)
+	}
+}
+
+// unlockedIsCollectingChannelList returns true if a LIST command is waiting for replies.
+// The done channel stays set after it's closed until the collector has read the results.
+func (ic *IRCClient) unlockedIsCollectingChannelList() bool {
+	if ic.channelListDone == nil {
+		return false
+	}
+	select {
+	case <-ic.channelListDone:
+		return false
+	default:
+		return true
+	}
+}
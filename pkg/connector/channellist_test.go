@@ -0,0 +1,66 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"testing"
+)
+
+func TestMatchMask(t *testing.T) {
+	testCases := []struct {
+		mask, str string
+		expected  bool
+	}{
+		{"#foo", "#foo", true},
+		{"#foo", "#foobar", false},
+		{"#foo*", "#foobar", true},
+		{"*bar", "#foobar", true},
+		{"*oo*", "#foobar", true},
+		{"#f?o", "#foo", true},
+		{"#f?o", "#fo", false},
+		{"*a*b*", "#xaxxbx", true},
+		{"*a*b", "#xaxxbx", false},
+		{"*", "", true},
+	}
+	for _, tc := range testCases {
+		if matchMask(tc.mask, tc.str) != tc.expected {
+			t.Errorf("Expected matchMask(%q, %q) to be %t", tc.mask, tc.str, tc.expected)
+		}
+	}
+}
+
+func TestChannelListFilter(t *testing.T) {
+	filter := parseChannelListFilter([]string{"matrix", "!*offtopic*", ">10"}, "#&")
+	casemap := casemapRFC1459.Replace
+	if param := filter.ServerParam("MNU"); param != "*matrix*,!*offtopic*,>10" {
+		t.Errorf("Unexpected server param with full ELIST support: %q", param)
+	}
+	if param := filter.ServerParam("U"); param != ">10" {
+		t.Errorf("Unexpected server param with partial ELIST support: %q", param)
+	}
+	entries := map[channelListEntry]bool{
+		{Name: "#Matrix", Users: 100}:          true,
+		{Name: "#matrix-offtopic", Users: 100}: false,
+		{Name: "#matrix-dev", Users: 10}:       false,
+		{Name: "#irc", Users: 100}:             false,
+	}
+	for entry, expected := range entries {
+		if filter.Match(entry, casemap) != expected {
+			t.Errorf("Expected %s with %d users to match: %t", entry.Name, entry.Users, expected)
+		}
+	}
+}
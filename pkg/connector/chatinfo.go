@@ -18,8 +18,10 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"iter"
+	"strings"
 	"time"
 
 	"go.mau.fi/util/ptr"
@@ -128,7 +130,9 @@ func (ic *IRCClient) GetChatInfo(ctx context.Context, portal *bridgev2.Portal) (
 	if err != nil {
 		return nil, err
 	}
-	if ic.isDM(channel) {
+	if channel == statusChannel {
+		return ic.getStatusInfo(), nil
+	} else if ic.isDM(channel) {
 		return ic.getDMInfo(channel), nil
 	} else {
 		return ic.getChannelInfo(channel), nil
@@ -142,17 +146,35 @@ func (ic *IRCClient) getUserInfo(nick string) *bridgev2.UserInfo {
 	}
 	nick = ic.isupport.CaseMapping(nick)
 	realNick := ic.casemappedNames.GetDefault(nick, nick)
-	return &bridgev2.UserInfo{
-		Identifiers: []string{fmt.Sprintf("irc%s://%s/%s", secure, ic.NetMeta.Address, nick)},
-		Name:        &realNick,
+	identifiers := []string{fmt.Sprintf("irc%s://%s/%s", secure, ic.NetMeta.Address, nick)}
+	user, _ := ic.getUser(nick)
+	if user.User != "" && user.Host != "" {
+		identifiers = append(identifiers, fmt.Sprintf("%s!%s@%s", realNick, user.User, user.Host))
 	}
+	info := &bridgev2.UserInfo{
+		Identifiers:  identifiers,
+		Name:         &realNick,
+		ExtraProfile: makeExtraProfile(user),
+	}
+	if user.User != "" {
+		// The bot mode is only known if the user has been seen in a WHO or WHOIS reply
+		info.IsBot = &user.Bot
+	}
+	return info
 }
 
 func (ic *IRCClient) GetUserInfo(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.UserInfo, error) {
-	nick, err := ic.parseUserID(ghost.ID)
-	if err != nil {
+	nick, err := ic.resolveUserID(ghost.ID)
+	if errors.Is(err, ErrAccountNotOnline) {
+		// Nobody is using the account right now, so just use the account name
+		name, _ := ic.parseUserID(ghost.ID)
+		return &bridgev2.UserInfo{
+			Name: ptr.Ptr(strings.TrimPrefix(name, accountIDPrefix)),
+		}, nil
+	} else if err != nil {
 		return nil, err
 	}
+	ic.fetchUserInfo(ctx, nick)
 	return ic.getUserInfo(nick), nil
 }
 
@@ -22,6 +22,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -29,8 +30,10 @@ import (
 	"go.mau.fi/util/exsync"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
 
 	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
 )
 
 type IRCClient struct {
@@ -48,12 +51,70 @@ type IRCClient struct {
 
 	isupport *ISupport
 
-	sendWaiters     map[string]sendWaiter
-	sendWaitersLock sync.Mutex
+	sendWaiters *sendWaiterQueue
+
+	joinWaitersLock sync.Mutex
+	joinWaiters     map[string][]chan *joinResult
 
 	casemappedNames *exsync.Map[string, string]
 
+	usersLock sync.RWMutex
+	users     map[string]*ircUser
+
+	channelAccountQueriesLock sync.Mutex
+	channelAccountQueries     map[string]ircmsg.Message
+
+	userQueryWaitersLock sync.Mutex
+	userQueryWaiters     map[string]chan struct{}
+
+	whoSearchLock        sync.Mutex
+	whoSearchResultsLock sync.Mutex
+	whoSearchResults     []string
+	whoSearchActive      bool
+
+	channelListLock        sync.Mutex
+	channelListCache       map[string]*cachedChannelList
+	channelListResultsLock sync.Mutex
+	channelListResults     []channelListEntry
+	channelListErr         error
+	channelListDone        chan struct{}
+
+	rawRequestLock    sync.Mutex
+	rawResultsLock    sync.Mutex
+	rawResults        []ircmsg.Message
+	rawResultsEnded   bool
+	rawResultsUpdated chan struct{}
+	rawReplyCollected bool
+
+	saslReauthLock sync.Mutex
+	saslReauth     *saslReauthState
+	connectResult  chan error
+
+	accountRegLock   sync.Mutex
+	accountRegResult chan *ircmsg.Message
+	// validatingLogin is set while the login flow is waiting for the first connection to succeed.
+	validatingLogin atomic.Bool
+
 	motdBuilder strings.Builder
+
+	roomFeaturesLock sync.Mutex
+	roomFeatures     map[roomFeaturesKey]*event.RoomFeatures
+
+	monitorLock    sync.Mutex
+	monitorTargets map[string]string
+	isonTargets    map[string]string
+	onlineNicks    map[string]bool
+	isonPending    [][]string
+	isonStop       chan struct{}
+
+	ownAwayLock    sync.Mutex
+	ownAwayMessage string
+	preAwaySent    bool
+
+	lagLock sync.Mutex
+	lag     time.Duration
+	// reportedLag is the lag that was last sent in the bridge state.
+	reportedLag time.Duration
 }
 
 var _ bridgev2.NetworkAPI = (*IRCClient)(nil)
@@ -76,6 +137,8 @@ func (ic *IRCConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 		RequestCaps: []string{
 			"message-tags", "server-time", "echo-message", "chghost", "draft/message-redaction",
 			"batch", "draft/multiline", "labeled-response", "draft/relaymsg",
+			"account-tag", "extended-join", "account-notify", "setname", "away-notify", "draft/pre-away",
+			"draft/account-registration",
 		},
 		QuitMessage: "Exiting the Matrix",
 		Version:     "mautrix-irc",
@@ -85,22 +148,33 @@ func (ic *IRCConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 		Log:         log.New(login.Log.With().Str("component", "irc").Logger(), "", 0),
 		PutIdent:    ic.Identd.Add,
 	}
+	ic.Config.Ping.configurePing(conn)
 	if meta.SASLUser != "" {
 		conn.SASLLogin = meta.SASLUser
 		conn.SASLPassword = meta.Password
 		conn.UseSASL = true
 	}
 	iclient := &IRCClient{
-		Main:            ic,
-		Conn:            conn,
-		UserLogin:       login,
-		NetMeta:         serverConfig,
-		stopping:        exsync.NewEvent(),
-		stopped:         exsync.NewEvent(),
-		isupport:        defaultISupport,
-		chatInfoCache:   make(map[string]*ChatInfoCache),
-		sendWaiters:     make(map[string]sendWaiter),
-		casemappedNames: exsync.NewMap[string, string](),
+		Main:                  ic,
+		Conn:                  conn,
+		UserLogin:             login,
+		NetMeta:               serverConfig,
+		stopping:              exsync.NewEvent(),
+		stopped:               exsync.NewEvent(),
+		isupport:              ic.getInitialISupport(ctx, serverConfig.Name),
+		chatInfoCache:         make(map[string]*ChatInfoCache),
+		sendWaiters:           newSendWaiterQueue(),
+		joinWaiters:           make(map[string][]chan *joinResult),
+		casemappedNames:       exsync.NewMap[string, string](),
+		users:                 make(map[string]*ircUser),
+		userQueryWaiters:      make(map[string]chan struct{}),
+		channelAccountQueries: make(map[string]ircmsg.Message),
+		channelListCache:      make(map[string]*cachedChannelList),
+		monitorTargets:        make(map[string]string),
+		isonTargets:           make(map[string]string),
+		onlineNicks:           make(map[string]bool),
+		roomFeatures:          make(map[roomFeaturesKey]*event.RoomFeatures),
+		connectResult:         make(chan error, 1),
 	}
 	login.Client = iclient
 	conn.OnNickChange = func(oldNick, newNick string) {
@@ -108,6 +182,10 @@ func (ic *IRCConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 			oldNick = iclient.Conn.Nick
 		}
 		ic.addLoginToMap(iclient, oldNick, newNick)
+		// The new nick is saved in onOwnNickChange, so also make it the preferred nick of the connection,
+		// which is used when reconnecting and which the connection would otherwise try to change back to.
+		// This is called with the connection state lock held, so the field can be set directly.
+		iclient.Conn.Nick = newNick
 	}
 	// This is slightly dangerous, but hopefully the connection happens quickly and sets the correct nick
 	ic.addLoginToMap(iclient, "", conn.Nick)
@@ -115,13 +193,19 @@ func (ic *IRCConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 	conn.AddConnectCallback(iclient.onConnect)
 	conn.AddDisconnectCallback(iclient.onDisconnect)
 	conn.AddBatchCallback(iclient.onBatch)
+	conn.AddGlobalCallback(iclient.onSASLReauth)
+	conn.AddGlobalCallback(iclient.onUserInfo)
 	conn.AddGlobalCallback(iclient.onFallbackReply)
+	conn.AddGlobalCallback(iclient.onRawReply)
+	conn.AddGlobalCallback(iclient.onStatusNumeric)
 	conn.AddCallback(ircevent.RPL_WELCOME, iclient.onWelcome)
 	conn.AddCallback(ircevent.RPL_YOURHOST, iclient.onWelcome)
 	conn.AddCallback(ircevent.RPL_CREATED, iclient.onWelcome)
 	conn.AddCallback(ircevent.RPL_MOTDSTART, iclient.onWelcome)
 	conn.AddCallback(ircevent.RPL_MOTD, iclient.onWelcome)
 	conn.AddCallback(ircevent.RPL_ENDOFMOTD, iclient.onWelcome)
+	conn.AddCallback(ircevent.ERR_NOMOTD, iclient.onWelcome)
+	conn.AddCallback("WALLOPS", iclient.onWallops)
 	conn.AddCallback("PRIVMSG", iclient.onMessage)
 	conn.AddCallback("NOTICE", iclient.onMessage)
 	conn.AddCallback("TAGMSG", iclient.onMessage)
@@ -134,19 +218,44 @@ func (ic *IRCConnector) LoadUserLogin(ctx context.Context, login *bridgev2.UserL
 	conn.AddCallback("QUIT", iclient.onQuit)
 	conn.AddCallback(ircevent.RPL_NAMREPLY, iclient.onUsers)
 	conn.AddCallback(ircevent.RPL_ENDOFNAMES, iclient.onUsersEnd)
+	conn.AddCallback(ircevent.RPL_ENDOFWHO, iclient.onEndOfWho)
 	conn.AddCallback("TOPIC", iclient.onNewTopic)
 	conn.AddCallback(ircevent.RPL_TOPIC, iclient.onOldTopic)
 	conn.AddCallback(ircevent.RPL_TOPICTIME, iclient.onTopicTime)
+	conn.AddCallback("PONG", iclient.onPong)
+	conn.AddCallback("CAP", iclient.onCapPreAway)
+	conn.AddCallback(ircevent.ERR_LINKCHANNEL, iclient.onLinkChannel)
+	conn.AddCallback(ircevent.RPL_MONONLINE, iclient.onMonitorOnline)
+	conn.AddCallback(ircevent.RPL_MONOFFLINE, iclient.onMonitorOffline)
+	conn.AddCallback(ircevent.ERR_MONLISTFULL, iclient.onMonitorListFull)
+	conn.AddCallback(ircevent.RPL_ISON, iclient.onISON)
+	conn.AddCallback(ircevent.RPL_LIST, iclient.onList)
+	conn.AddCallback(ircevent.RPL_LISTEND, iclient.onListEnd)
+	conn.AddCallback(ircevent.RPL_TRYAGAIN, iclient.onTryAgain)
+	for _, numeric := range joinErrorNumerics {
+		conn.AddCallback(numeric, iclient.onJoinError)
+	}
+	conn.AddCallback("REGISTER", iclient.onAccountRegistration)
+	conn.AddCallback("VERIFY", iclient.onAccountRegistration)
+	conn.AddCallback("FAIL", iclient.onStandardReply)
+	conn.AddCallback("WARN", iclient.onStandardReply)
+	conn.AddCallback("NOTE", iclient.onStandardReply)
 	iclient.stopped.Set()
 	return nil
 }
 
+var joinErrorNumerics = []string{
+	ircevent.ERR_NOSUCHCHANNEL, ircevent.ERR_TOOMANYCHANNELS, ircevent.ERR_CHANNELISFULL, ircevent.ERR_INVITEONLYCHAN,
+	ircevent.ERR_BANNEDFROMCHAN, ircevent.ERR_BADCHANNELKEY, ircevent.ERR_NEEDREGGEDNICK, "489", "520",
+}
+
 func init() {
 	status.BridgeStateHumanErrors.Update(status.BridgeStateErrorMap{
 		"irc-unknown-network": "This network was removed from the bridge config",
-		"irc-sasl-fail":       "Failed to authenticate on IRC",
+		"irc-sasl-fail":       "Failed to authenticate on IRC, use the set-sasl command to change your credentials",
 		"irc-connect-fail":    "Failed to connect to IRC, trying to reconnect...",
 		"irc-disconnected":    "Disconnected from IRC, trying to reconnect...",
+		"irc-ping-timeout":    "IRC server stopped responding, trying to reconnect...",
 	})
 }
 
@@ -182,6 +291,15 @@ func (ic *IRCClient) connectLoop(ctx context.Context) {
 				Error:      "irc-sasl-fail",
 				Info:       map[string]any{"go_error": err.Error()},
 			})
+			ic.notifyConnectResult(err)
+			if ic.validatingLogin.Load() {
+				// The login flow reports the error itself
+				return
+			}
+			ic.sendNotice(ctx, "", fmt.Sprintf(
+				"Failed to authenticate on %s: %s\n\nUse `%s set-sasl %s <username>:<password>` to fix your credentials.",
+				ic.NetMeta.DisplayName, err, ic.Main.Bridge.Config.CommandPrefix, ic.NetMeta.Name,
+			), time.Now())
 			return
 		} else if err != nil {
 			ic.UserLogin.Log.Err(err).Msg("Error establishing connection")
@@ -190,6 +308,7 @@ func (ic *IRCClient) connectLoop(ctx context.Context) {
 				Error:      "irc-connect-fail",
 				Info:       map[string]any{"go_error": err.Error()},
 			})
+			ic.notifyConnectResult(err)
 			connectFailures++
 		} else {
 			connectFailures = 0
@@ -201,9 +320,13 @@ func (ic *IRCClient) connectLoop(ctx context.Context) {
 			err = ic.Conn.InternalGetError()
 			if err != nil {
 				ic.UserLogin.Log.Err(err).Msg("Error in connection")
+				errCode := status.BridgeStateErrorCode("irc-disconnected")
+				if errors.Is(err, ircevent.ServerTimedOut) {
+					errCode = "irc-ping-timeout"
+				}
 				ic.UserLogin.BridgeState.Send(status.BridgeState{
 					StateEvent: status.StateTransientDisconnect,
-					Error:      "irc-disconnected",
+					Error:      errCode,
 					Info:       map[string]any{"go_error": err.Error()},
 				})
 				connectFailures++
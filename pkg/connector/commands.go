@@ -19,9 +19,15 @@ package connector
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/commands"
 	"maunium.net/go/mautrix/format"
@@ -55,16 +61,14 @@ var cmdSetSASL = &commands.FullHandler{
 		if !strings.ContainsRune(remainingArgs, ':') {
 			ce.Reply("Current SASL credentials: %s:%s", format.SafeMarkdownCode(meta.SASLUser), format.SafeMarkdownCode(meta.Password))
 		} else {
-			parts := strings.SplitN(remainingArgs, ":", 2)
-			meta.SASLUser = parts[0]
-			meta.Password = parts[1]
-			err := login.Save(ce.Ctx)
+			user, password, _ := strings.Cut(remainingArgs, ":")
+			ce.Reply("Authenticating with %s:%s...", format.SafeMarkdownCode(user), format.SafeMarkdownCode(password))
+			err := ce.Bridge.Network.(*IRCConnector).applySASLCredentials(ce.Ctx, login, user, password)
 			if err != nil {
-				ce.Log.Err(err).Msg("Failed to save login after changing SASL credentials")
-				ce.Reply("Failed to save new SASL credentials")
-				return
+				ce.Reply("Failed to authenticate with the new credentials, keeping the previous ones: %s", humanizeError(err))
+			} else {
+				ce.Reply("Successfully authenticated and saved the new credentials")
 			}
-			ce.Reply("Changed SASL credentials to %s:%s", format.SafeMarkdownCode(meta.SASLUser), format.SafeMarkdownCode(meta.Password))
 		}
 	},
 	Name:    "set-sasl",
@@ -104,34 +108,199 @@ var cmdJoin = &commands.FullHandler{
 			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(netName), getLogins(ce.User))
 			return
 		}
-		channel := ce.Args[0]
-		meta := login.Metadata.(*UserLoginMetadata)
-		cli := login.Client.(*IRCClient)
-		err := cli.Conn.Join(channel)
-		if err != nil {
-			ce.Reply("Failed to join channel: %s", err)
+		joinChannel(ce, login, ce.Args[0])
+	},
+	Name: "join",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Join a channel and add it to your autojoin list",
+		Args:        "[network] <channel>",
+	},
+	RequiresLogin: true,
+}
+
+const channelListPageSize = 20
+
+// channelListState is the command state after a list command, which allows joining channels
+// by replying with their number and switching pages.
+type channelListState struct {
+	Login   *bridgev2.UserLogin
+	NetName string
+	Entries []channelListEntry
+	Page    int
+}
+
+func (cls *channelListState) pageCount() int {
+	return max(1, (len(cls.Entries)+channelListPageSize-1)/channelListPageSize)
+}
+
+func truncateTopic(topic string) string {
+	runes := []rune(topic)
+	if len(runes) > 150 {
+		return string(runes[:150]) + "…"
+	}
+	return topic
+}
+
+func (cls *channelListState) format() string {
+	start := cls.Page * channelListPageSize
+	end := min(start+channelListPageSize, len(cls.Entries))
+	var buf strings.Builder
+	_, _ = fmt.Fprintf(
+		&buf, "Found %d channels on %s (page %d of %d):\n\n",
+		len(cls.Entries), format.SafeMarkdownCode(cls.NetName), cls.Page+1, cls.pageCount(),
+	)
+	for i, entry := range cls.Entries[start:end] {
+		_, _ = fmt.Fprintf(&buf, "%d. %s (%d users)", start+i+1, format.SafeMarkdownCode(entry.Name), entry.Users)
+		if entry.Topic != "" {
+			_, _ = fmt.Fprintf(&buf, " - %s", format.EscapeMarkdown(truncateTopic(entry.Topic)))
+		}
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("\nReply with the number of a channel to join it")
+	if cls.pageCount() > 1 {
+		buf.WriteString(", or `next` and `prev` to switch pages")
+	}
+	return buf.String()
+}
+
+func (cls *channelListState) handleReply(ce *commands.Event) {
+	input := strings.ToLower(strings.TrimSpace(ce.RawArgs))
+	switch input {
+	case "next":
+		cls.Page = min(cls.Page+1, cls.pageCount()-1)
+		ce.Reply(cls.format())
+	case "prev", "previous":
+		cls.Page = max(cls.Page-1, 0)
+		ce.Reply(cls.format())
+	default:
+		num, err := strconv.Atoi(input)
+		if err != nil || num < 1 || num > len(cls.Entries) {
+			ce.Reply("Reply with a number between 1 and %d to join a channel, or use `$cmdprefix cancel` to stop", len(cls.Entries))
 			return
 		}
-		if slices.Contains(meta.Channels, channel) {
-			ce.Reply("%s is already on your autojoin list", format.SafeMarkdownCode(channel))
-		} else {
-			meta.Channels = append(meta.Channels, channel)
-			err = login.Save(ce.Ctx)
+		commands.StoreCommandState(ce.User, nil)
+		joinChannel(ce, cls.Login, cls.Entries[num-1].Name)
+	}
+}
+
+var cmdList = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		var netName string
+		if len(ce.Args) > 0 && ce.Bridge.Network.(*IRCConnector).networkExists(ce.Args[0]) {
+			netName = ce.Args[0]
+			ce.Args = ce.Args[1:]
+		} else if ce.Portal != nil {
+			var err error
+			netName, _, err = parsePortalID(ce.Portal.ID)
 			if err != nil {
-				ce.Log.Err(err).Msg("Failed to save login after adding autojoin channel")
+				ce.Reply("Failed to parse portal ID: %s", err)
+				return
 			}
-			ce.Reply("Joined %s and added it to your autojoin list", format.SafeMarkdownCode(channel))
+		} else {
+			ce.Reply("Usage: $cmdprefix list [network] [filters...]\n\nThe network argument is required when outside of a network room.")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(netName, ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(netName), getLogins(ce.User))
+			return
+		}
+		cli := login.Client.(*IRCClient)
+		if !cli.IsLoggedIn() {
+			ce.Reply("You are not connected to %s", format.SafeMarkdownCode(netName))
+			return
+		}
+		filter := parseChannelListFilter(ce.Args, cli.isupport.ChanTypes)
+		entries, err := cli.listChannels(ce.Ctx, filter)
+		if err != nil {
+			ce.Reply("Failed to list channels: %s", humanizeError(err))
+			return
+		} else if len(entries) == 0 {
+			ce.Reply("No channels found")
+			return
 		}
+		state := &channelListState{
+			Login:   login,
+			NetName: netName,
+			Entries: entries,
+		}
+		commands.StoreCommandState(ce.User, &commands.CommandState{
+			Next:   commands.MinimalCommandHandlerFunc(state.handleReply),
+			Action: "Channel list",
+		})
+		ce.Reply(state.format())
 	},
-	Name: "join",
+	Name: "list",
 	Help: commands.HelpMeta{
-		Section:     commands.HelpSectionChats,
-		Description: "Join a channel and add it to your autojoin list",
-		Args:        "[network] <channel>",
+		Section: commands.HelpSectionChats,
+		Description: "Search the channels on a network. Filters can be channel masks, search terms, " +
+			"`!mask` to exclude channels, and `>count` or `<count` to limit the number of users",
+		Args: "[network] [filters...]",
 	},
 	RequiresLogin: true,
 }
 
+// joinChannel joins a channel and adds it to the autojoin list of the login.
+func joinChannel(ce *commands.Event, login *bridgev2.UserLogin, channel string) {
+	meta := login.Metadata.(*UserLoginMetadata)
+	cli := login.Client.(*IRCClient)
+	_, err := cli.JoinChannel(ce.Ctx, channel)
+	var ircErr *IRCError
+	if errors.As(err, &ircErr) && ircErr.Msg.Command == ircevent.ERR_LINKCHANNEL && len(ircErr.Msg.Params) >= 3 {
+		newChannel := ircErr.Msg.Params[2]
+		cli.recordChannelForward(ce.Ctx, channel, newChannel)
+		ce.Reply(
+			"%s forwarded you to %s, which was added to your autojoin list instead",
+			format.SafeMarkdownCode(channel), format.SafeMarkdownCode(newChannel),
+		)
+		return
+	} else if err != nil && !errors.Is(err, ErrAlreadyInChannel) {
+		ce.Reply("Failed to join %s: %s", format.SafeMarkdownCode(channel), humanizeError(err))
+		return
+	}
+	if slices.Contains(meta.Channels, channel) {
+		ce.Reply("%s is already on your autojoin list", format.SafeMarkdownCode(channel))
+	} else {
+		meta.Channels = append(meta.Channels, channel)
+		saveErr := login.Save(ce.Ctx)
+		if saveErr != nil {
+			ce.Log.Err(saveErr).Msg("Failed to save login after adding autojoin channel")
+		}
+		if err != nil {
+			ce.Reply("Added %s to your autojoin list", format.SafeMarkdownCode(channel))
+		} else {
+			ce.Reply("Joined %s and added it to your autojoin list", format.SafeMarkdownCode(channel))
+		}
+	}
+}
+
+// splitRawArgs handles the trailing parameter in space-separated IRC command parameters:
+// the first parameter starting with a colon contains the rest of the line.
+func splitRawArgs(args []string) []string {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, ":") {
+			args[i] = strings.Join(args[i:], " ")
+			args[i] = strings.TrimPrefix(args[i], ":")
+			return args[:i+1]
+		}
+	}
+	return args
+}
+
+// formatRawResponse formats IRC lines as a markdown code block.
+func formatRawResponse(msgs []ircmsg.Message) string {
+	var buf strings.Builder
+	buf.WriteString("```\n")
+	for _, msg := range msgs {
+		line, _ := msg.Line()
+		buf.WriteString(strings.TrimSpace(strings.ReplaceAll(line, "```", "` ` `")))
+		buf.WriteByte('\n')
+	}
+	buf.WriteString("```")
+	return buf.String()
+}
+
 var cmdRaw = &commands.FullHandler{
 	Func: func(ce *commands.Event) {
 		if len(ce.Args) == 0 {
@@ -170,22 +339,15 @@ var cmdRaw = &commands.FullHandler{
 			ce.Args = strings.Fields(strings.TrimSpace(buf.String()))
 		}
 		cmd := strings.ToUpper(ce.Args[0])
-		args := ce.Args[1:]
-		for i, arg := range args {
-			if strings.HasPrefix(arg, ":") {
-				args[i] = strings.Join(args[i:], " ")
-				args[i] = strings.TrimPrefix(args[i], ":")
-				args = args[:i+1]
-				break
-			}
-		}
+		args := splitRawArgs(ce.Args[1:])
 
-		resp, err := login.Client.(*IRCClient).SendRequest(ce.Ctx, tags, "", cmd, args...)
+		resp, err := login.Client.(*IRCClient).SendRawRequest(ce.Ctx, tags, cmd, args...)
 		if err != nil {
 			ce.Reply("Failed to send command: %s", err)
+		} else if len(resp) == 0 {
+			ce.Reply("Command sent, no response received")
 		} else {
-			line, _ := resp.Line()
-			ce.Reply("Got response: %s", format.SafeMarkdownCode(line))
+			ce.Reply("Got response:\n\n%s", formatRawResponse(resp))
 		}
 	},
 	Name: "raw",
@@ -196,3 +358,279 @@ var cmdRaw = &commands.FullHandler{
 	},
 	RequiresLogin: true,
 }
+
+func formatLoginStatus(login *bridgev2.UserLogin) string {
+	netName, _, _ := parseUserLoginID(login.ID)
+	cli, ok := login.Client.(*IRCClient)
+	if !ok || cli.Conn == nil {
+		return fmt.Sprintf("* %s: unknown network", format.SafeMarkdownCode(netName))
+	} else if !cli.Conn.Connected() {
+		return fmt.Sprintf("* %s: not connected", format.SafeMarkdownCode(netName))
+	}
+	status := fmt.Sprintf("* %s: connected as %s", format.SafeMarkdownCode(netName), format.SafeMarkdownCode(cli.Conn.CurrentNick()))
+	if lag := cli.GetLag(); lag > 0 {
+		status += fmt.Sprintf(", lag %s", lag.Round(time.Millisecond))
+	}
+	return status
+}
+
+var cmdStatus = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		var netName string
+		if len(ce.Args) > 0 {
+			netName = ce.Args[0]
+		} else if ce.Portal != nil {
+			netName, _, _ = parsePortalID(ce.Portal.ID)
+		}
+		if netName != "" {
+			login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(netName, ce.User.MXID))
+			if login == nil {
+				ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(netName), getLogins(ce.User))
+				return
+			}
+			ce.Reply(formatLoginStatus(login))
+			return
+		}
+		logins := ce.User.GetUserLogins()
+		lines := make([]string, len(logins))
+		for i, login := range logins {
+			lines[i] = formatLoginStatus(login)
+		}
+		ce.Reply(strings.Join(lines, "\n"))
+	},
+	Name: "status",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show the connection status and lag of your IRC networks",
+		Args:        "[network]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdAwayMessage = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		if len(ce.Args) == 0 {
+			ce.Reply("Usage: $cmdprefix away-message <network> [message | off | default]")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(ce.Args[0], ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(ce.Args[0]), getLogins(ce.User))
+			return
+		}
+		meta := login.Metadata.(*UserLoginMetadata)
+		message := strings.TrimSpace(strings.TrimPrefix(ce.RawArgs, ce.Args[0]))
+		switch strings.ToLower(message) {
+		case "":
+			if meta.DisableAutoAway {
+				ce.Reply("Automatic away status is disabled")
+			} else if meta.AwayMessage != "" {
+				ce.Reply("Current away message: %s", format.SafeMarkdownCode(meta.AwayMessage))
+			} else {
+				ce.Reply("Using the default away message")
+			}
+			return
+		case "off":
+			meta.DisableAutoAway = true
+			meta.AwayMessage = ""
+		case "default":
+			meta.DisableAutoAway = false
+			meta.AwayMessage = ""
+		default:
+			meta.DisableAutoAway = false
+			meta.AwayMessage = message
+		}
+		err := login.Save(ce.Ctx)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to save login after changing away message")
+			ce.Reply("Failed to save away message")
+			return
+		}
+		if meta.DisableAutoAway {
+			ce.Reply("Disabled automatic away status")
+		} else if meta.AwayMessage != "" {
+			ce.Reply("Changed away message to %s", format.SafeMarkdownCode(meta.AwayMessage))
+		} else {
+			ce.Reply("Reset away message to the default")
+		}
+	},
+	Name: "away-message",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Change the away message used when your Matrix presence is idle, or disable automatic away status",
+		Args:        "<network> [message | off | default]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdPassthrough = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		if len(ce.Args) == 0 {
+			ce.Reply("Usage: $cmdprefix passthrough <network> [on | off]")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(ce.Args[0], ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(ce.Args[0]), getLogins(ce.User))
+			return
+		}
+		prefix := login.Bridge.Network.(*IRCConnector).Config.PassthroughPrefix
+		if prefix == "" {
+			ce.Reply("Command passthrough is disabled on this bridge")
+			return
+		}
+		meta := login.Metadata.(*UserLoginMetadata)
+		if len(ce.Args) < 2 {
+			if meta.CommandPassthrough {
+				ce.Reply("Command passthrough is enabled: messages starting with %s are sent as IRC commands", format.SafeMarkdownCode(prefix))
+			} else {
+				ce.Reply("Command passthrough is disabled")
+			}
+			return
+		}
+		switch strings.ToLower(ce.Args[1]) {
+		case "on", "enable", "true":
+			meta.CommandPassthrough = true
+		case "off", "disable", "false":
+			meta.CommandPassthrough = false
+		default:
+			ce.Reply("Usage: $cmdprefix passthrough <network> [on | off]")
+			return
+		}
+		err := login.Save(ce.Ctx)
+		if err != nil {
+			ce.Log.Err(err).Msg("Failed to save login after changing command passthrough")
+			ce.Reply("Failed to save command passthrough setting")
+			return
+		}
+		if meta.CommandPassthrough {
+			ce.Reply("Enabled command passthrough: messages starting with %s in portals are now sent as IRC commands", format.SafeMarkdownCode(prefix))
+		} else {
+			ce.Reply("Disabled command passthrough")
+		}
+	},
+	Name: "passthrough",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Enable or disable sending messages starting with the passthrough prefix as IRC commands like /mode or /kick",
+		Args:        "<network> [on | off]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdWhois = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		var netName, nick string
+		if len(ce.Args) > 0 && ce.Bridge.Network.(*IRCConnector).networkExists(ce.Args[0]) {
+			netName = ce.Args[0]
+			ce.Args = ce.Args[1:]
+		} else if ce.Portal != nil {
+			netName, _, _ = parsePortalID(ce.Portal.ID)
+		}
+		if netName == "" {
+			ce.Reply("Usage: $cmdprefix whois [network] <nick>")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(netName, ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(netName), getLogins(ce.User))
+			return
+		}
+		cli := login.Client.(*IRCClient)
+		if len(ce.Args) > 0 {
+			nick = ce.Args[0]
+		} else if ce.Portal != nil {
+			channel, err := cli.parsePortalID(ce.Portal.ID)
+			if err == nil && channel != statusChannel && cli.isDM(channel) {
+				nick = cli.casemappedNames.GetDefault(channel, channel)
+			}
+		}
+		if nick == "" {
+			ce.Reply("Usage: $cmdprefix whois [network] <nick>")
+			return
+		}
+		info, err := cli.Whois(ce.Ctx, nick)
+		if err != nil {
+			ce.Reply("Failed to get info of %s: %s", format.SafeMarkdownCode(nick), humanizeError(err))
+			return
+		}
+		ce.Reply(info.Format())
+	},
+	Name: "whois",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionChats,
+		Description: "Show information about an IRC user. The nick can be omitted in private chat portals.",
+		Args:        "[network] <nick>",
+	},
+	RequiresLogin: true,
+}
+
+var cmdNick = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		if len(ce.Args) == 0 {
+			ce.Reply("Usage: $cmdprefix nick <network> [new nick]")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(ce.Args[0], ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(ce.Args[0]), getLogins(ce.User))
+			return
+		}
+		cli := login.Client.(*IRCClient)
+		if len(ce.Args) < 2 {
+			ce.Reply("Your nick is %s", format.SafeMarkdownCode(cli.Conn.CurrentNick()))
+			return
+		}
+		err := cli.SetNick(ce.Ctx, ce.Args[1])
+		if err != nil {
+			ce.Reply("Failed to change nick: %s", err)
+		} else if !cli.Conn.Connected() {
+			ce.Reply("Changed nick to %s, it will be used the next time the bridge connects", format.SafeMarkdownCode(ce.Args[1]))
+		} else {
+			ce.Reply("Changed nick to %s", format.SafeMarkdownCode(cli.Conn.CurrentNick()))
+		}
+	},
+	Name: "nick",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Change your nick on an IRC network",
+		Args:        "<network> [new nick]",
+	},
+	RequiresLogin: true,
+}
+
+var cmdRealName = &commands.FullHandler{
+	Func: func(ce *commands.Event) {
+		if len(ce.Args) == 0 {
+			ce.Reply("Usage: $cmdprefix realname <network> [new real name]")
+			return
+		}
+		login := ce.Bridge.GetCachedUserLoginByID(makeUserLoginID(ce.Args[0], ce.User.MXID))
+		if login == nil {
+			ce.Reply("You are not logged into %s (active logins: %s)", format.SafeMarkdownCode(ce.Args[0]), getLogins(ce.User))
+			return
+		}
+		cli := login.Client.(*IRCClient)
+		realName := strings.TrimSpace(strings.TrimPrefix(ce.RawArgs, ce.Args[0]))
+		if realName == "" {
+			ce.Reply("Your real name is %s", format.SafeMarkdownCode(login.Metadata.(*UserLoginMetadata).RealName))
+			return
+		}
+		appliedNow, err := cli.SetRealName(ce.Ctx, realName)
+		if err != nil {
+			ce.Reply("Failed to change real name: %s", err)
+		} else if appliedNow {
+			ce.Reply("Changed real name to %s", format.SafeMarkdownCode(realName))
+		} else {
+			ce.Reply("Changed real name to %s, it will be used the next time the bridge connects", format.SafeMarkdownCode(realName))
+		}
+	},
+	Name:    "realname",
+	Aliases: []string{"real-name", "setname"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Change your real name (gecos) on an IRC network",
+		Args:        "<network> [new real name]",
+	},
+	RequiresLogin: true,
+}
@@ -18,9 +18,11 @@ package connector
 
 import (
 	_ "embed"
+	"fmt"
 	"strings"
 
 	up "go.mau.fi/util/configupgrade"
+	"golang.org/x/text/encoding"
 	"gopkg.in/yaml.v3"
 	"maunium.net/go/mautrix/id"
 )
@@ -36,6 +38,17 @@ type NetworkConfig struct {
 	TLS         bool                `yaml:"tls"`
 	CTCP        bool                `yaml:"ctcp"`
 	Name        string              `yaml:"-"`
+
+	AccountGhosts bool `yaml:"account_ghosts"`
+
+	NewChannelModes  string `yaml:"new_channel_modes"`
+	RegisterChannels bool   `yaml:"register_channels"`
+
+	Encoding         string            `yaml:"encoding"`
+	ChannelEncodings map[string]string `yaml:"channel_encodings"`
+
+	encodings        []encoding.Encoding
+	channelEncodings map[string][]encoding.Encoding
 }
 
 type IdentdConfig struct {
@@ -43,9 +56,24 @@ type IdentdConfig struct {
 	StrictRemote bool   `yaml:"strict_remote"`
 }
 
+type PingConfig struct {
+	Interval int `yaml:"interval"`
+	MaxLag   int `yaml:"max_lag"`
+}
+
+type AwayConfig struct {
+	GhostPresence  bool   `yaml:"ghost_presence"`
+	MatrixPresence bool   `yaml:"matrix_presence"`
+	DefaultMessage string `yaml:"default_message"`
+}
+
 type Config struct {
 	Networks map[string]*NetworkConfig `yaml:"networks"`
 	Identd   IdentdConfig              `yaml:"identd"`
+	Ping     PingConfig                `yaml:"ping"`
+	Away     AwayConfig                `yaml:"away"`
+
+	PassthroughPrefix string `yaml:"passthrough_prefix"`
 }
 
 func (ic *IRCConnector) GetConfig() (example string, data any, upgrader up.Upgrader) {
@@ -77,6 +105,17 @@ func (c *Config) PostProcess() (err error) {
 			name = strings.ToLower(name)
 		}
 		net.Name = name
+		net.encodings, err = parseEncodings(net.Encoding)
+		if err != nil {
+			return fmt.Errorf("invalid encoding for network %s: %w", name, err)
+		}
+		net.channelEncodings = make(map[string][]encoding.Encoding, len(net.ChannelEncodings))
+		for channel, encodingNames := range net.ChannelEncodings {
+			net.channelEncodings[channel], err = parseEncodings(encodingNames)
+			if err != nil {
+				return fmt.Errorf("invalid encoding for %s on network %s: %w", channel, name, err)
+			}
+		}
 	}
 	return
 }
@@ -85,4 +124,10 @@ func upgradeConfig(helper up.Helper) {
 	helper.Copy(up.Map, "networks")
 	helper.Copy(up.Str|up.Null, "identd.address")
 	helper.Copy(up.Bool, "identd.strict_remote")
+	helper.Copy(up.Int, "ping.interval")
+	helper.Copy(up.Int, "ping.max_lag")
+	helper.Copy(up.Bool, "away.ghost_presence")
+	helper.Copy(up.Bool, "away.matrix_presence")
+	helper.Copy(up.Str, "away.default_message")
+	helper.Copy(up.Str, "passthrough_prefix")
 }
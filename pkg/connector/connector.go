@@ -23,7 +23,9 @@ import (
 
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/commands"
+	"maunium.net/go/mautrix/bridgev2/matrix"
 	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/event"
 
 	"go.mau.fi/mautrix-irc/pkg/connector/ircdb"
 	"go.mau.fi/mautrix-irc/pkg/identd"
@@ -42,6 +44,8 @@ type IRCConnector struct {
 
 	userLogins     map[netNickPair]*IRCClient
 	userLoginsLock sync.RWMutex
+
+	casemapMigrationLock sync.Mutex
 }
 
 var _ bridgev2.NetworkConnector = (*IRCConnector)(nil)
@@ -55,7 +59,10 @@ func (ic *IRCConnector) Init(bridge *bridgev2.Bridge) {
 		ic.Config.Identd.Address,
 		ic.Config.Identd.StrictRemote,
 	)
-	bridge.Commands.(*commands.Processor).AddHandlers(cmdSetSASL, cmdJoin, cmdRaw)
+	bridge.Commands.(*commands.Processor).AddHandlers(cmdSetSASL, cmdJoin, cmdList, cmdRaw, cmdStatus, cmdAwayMessage, cmdPassthrough, cmdWhois, cmdNick, cmdRealName)
+	if mc, ok := bridge.Matrix.(*matrix.Connector); ok {
+		mc.EventProcessor.On(event.EphemeralEventPresence, ic.handleMatrixPresence)
+	}
 }
 
 func (ic *IRCConnector) Start(ctx context.Context) error {
@@ -0,0 +1,211 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+)
+
+var _ bridgev2.ContactListingNetworkAPI = (*IRCClient)(nil)
+var _ bridgev2.UserSearchingNetworkAPI = (*IRCClient)(nil)
+
+// whoSearchToken is the token used in WHOX queries for user searches, so that the replies
+// can be collected separately from normal user info queries.
+const whoSearchToken = "138"
+
+// searchResultLimit is the maximum number of users returned from a search.
+const searchResultLimit = 50
+
+// getDMPortalIDs returns the IDs of all DM portals that belong to the user login.
+func (ic *IRCClient) getDMPortalIDs(ctx context.Context) ([]networkid.PortalID, error) {
+	portals, err := ic.Main.Bridge.DB.Portal.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []networkid.PortalID
+	for _, portal := range portals {
+		if portal.Receiver == ic.UserLogin.ID && portal.RoomType == database.RoomTypeDM {
+			ids = append(ids, portal.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (ic *IRCClient) GetContactList(ctx context.Context) ([]*bridgev2.ResolveIdentifierResponse, error) {
+	contacts := make(map[string]string)
+	ic.monitorLock.Lock()
+	maps.Copy(contacts, ic.monitorTargets)
+	maps.Copy(contacts, ic.isonTargets)
+	ic.monitorLock.Unlock()
+	// The monitor targets are only filled after connecting, so check the DM portals too
+	portalIDs, err := ic.getDMPortalIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DM portals: %w", err)
+	}
+	for _, portalID := range portalIDs {
+		nick, err := ic.parsePortalID(portalID)
+		if err != nil || !ic.isDM(nick) {
+			continue
+		} else if _, ok := contacts[nick]; !ok {
+			contacts[nick] = ic.casemappedNames.GetDefault(nick, nick)
+		}
+	}
+	resp := make([]*bridgev2.ResolveIdentifierResponse, 0, len(contacts))
+	for _, mappedNick := range slices.Sorted(maps.Keys(contacts)) {
+		contact, err := ic.makeResolveIdentifierResponse(ctx, contacts[mappedNick])
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, contact)
+	}
+	return resp, nil
+}
+
+func (ic *IRCClient) SearchUsers(ctx context.Context, query string) ([]*bridgev2.ResolveIdentifierResponse, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+	ownNick := ic.isupport.CaseMapping(ic.Conn.CurrentNick())
+	seen := map[string]struct{}{ownNick: {}}
+	var nicks []string
+	addNick := func(nick string) {
+		mappedNick := ic.isupport.CaseMapping(nick)
+		if _, ok := seen[mappedNick]; !ok && len(nicks) < searchResultLimit {
+			seen[mappedNick] = struct{}{}
+			nicks = append(nicks, nick)
+		}
+	}
+	for _, nick := range ic.searchChannelMembers(query) {
+		addNick(nick)
+	}
+	if ic.IsLoggedIn() {
+		whoResults, err := ic.searchWHO(ctx, query)
+		if err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Str("query", query).Msg("Failed to search users with WHO")
+		}
+		for _, nick := range whoResults {
+			addNick(nick)
+		}
+	}
+	resp := make([]*bridgev2.ResolveIdentifierResponse, 0, len(nicks))
+	for _, nick := range nicks {
+		if ic.validateNick(nick) != nil {
+			continue
+		}
+		result, err := ic.makeResolveIdentifierResponse(ctx, nick)
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, result)
+	}
+	return resp, nil
+}
+
+// searchChannelMembers returns the members of joined channels whose nick contains the query.
+func (ic *IRCClient) searchChannelMembers(query string) []string {
+	mappedQuery := ic.isupport.CaseMapping(query)
+	found := make(map[string]string)
+	ic.chatInfoCacheLock.RLock()
+	for _, info := range ic.chatInfoCache {
+		for nick := range info.Members {
+			mappedNick := ic.isupport.CaseMapping(nick)
+			if strings.Contains(mappedNick, mappedQuery) {
+				found[mappedNick] = nick
+			}
+		}
+	}
+	ic.chatInfoCacheLock.RUnlock()
+	return slices.Collect(maps.Values(found))
+}
+
+// makeWHOSearchMask turns a search query into a WHO mask. Queries that already look like masks
+// are used as-is, anything else is matched as a substring.
+func makeWHOSearchMask(query string) string {
+	if strings.ContainsAny(query, "*?!@") {
+		return query
+	}
+	return fmt.Sprintf("*%s*", query)
+}
+
+// searchWHO sends a WHO query with a mask based on the search query and returns the nicks in the replies.
+func (ic *IRCClient) searchWHO(ctx context.Context, query string) ([]string, error) {
+	ic.whoSearchLock.Lock()
+	defer ic.whoSearchLock.Unlock()
+	ic.whoSearchResultsLock.Lock()
+	ic.whoSearchResults, ic.whoSearchActive = nil, true
+	ic.whoSearchResultsLock.Unlock()
+	defer func() {
+		ic.whoSearchResultsLock.Lock()
+		ic.whoSearchResults, ic.whoSearchActive = nil, false
+		ic.whoSearchResultsLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	mask := makeWHOSearchMask(query)
+	args := []string{mask}
+	if ic.isupport.WHOX {
+		args = append(args, fmt.Sprintf("%s,%s", whoxFields, whoSearchToken))
+	}
+	resp, err := ic.getLabeledResponse(ctx, nil, "WHO", args...)
+	if err == nil {
+		ic.handleLabeledUserInfo(resp)
+	} else if !errors.Is(err, ircevent.CapabilityNotNegotiated) {
+		return nil, err
+	} else {
+		waiter := ic.addUserQueryWaiter(mask)
+		err = ic.Conn.Send("WHO", args...)
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-waiter:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	ic.whoSearchResultsLock.Lock()
+	defer ic.whoSearchResultsLock.Unlock()
+	return slices.Clone(ic.whoSearchResults), nil
+}
+
+func (ic *IRCClient) isSearchingWHO() bool {
+	ic.whoSearchResultsLock.Lock()
+	defer ic.whoSearchResultsLock.Unlock()
+	return ic.whoSearchActive
+}
+
+func (ic *IRCClient) addWhoSearchResult(nick string) {
+	ic.whoSearchResultsLock.Lock()
+	defer ic.whoSearchResultsLock.Unlock()
+	if ic.whoSearchActive {
+		ic.whoSearchResults = append(ic.whoSearchResults, nick)
+	}
+}
@@ -41,6 +41,11 @@ type UserLoginMetadata struct {
 	Password string   `json:"password"`
 	SASLUser string   `json:"sasl_user"`
 	Channels []string `json:"channels"`
+
+	AwayMessage     string `json:"away_message,omitempty"`
+	DisableAutoAway bool   `json:"disable_auto_away,omitempty"`
+
+	CommandPassthrough bool `json:"command_passthrough,omitempty"`
 }
 
 type ReactionMetadata struct {
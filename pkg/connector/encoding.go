@@ -0,0 +1,122 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// defaultFallbackEncodings are used to decode incoming text that isn't valid UTF-8
+// on networks that don't have an encoding configured.
+var defaultFallbackEncodings = []encoding.Encoding{charmap.Windows1252}
+
+// parseEncodings parses a comma-separated list of encoding names.
+func parseEncodings(names string) ([]encoding.Encoding, error) {
+	var encodings []encoding.Encoding
+	for name := range strings.SplitSeq(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown encoding %q", name)
+		}
+		encodings = append(encodings, enc)
+	}
+	return encodings, nil
+}
+
+// getEncodings returns the encodings configured for the given channel or nick, or for the network
+// if the channel doesn't have its own setting. It returns nil if the server only allows UTF-8.
+func (ic *IRCClient) getEncodings(channel string) []encoding.Encoding {
+	if ic.isupport.UTF8Only {
+		return nil
+	}
+	if channel != "" {
+		channel = ic.isupport.CaseMapping(channel)
+		for name, encodings := range ic.NetMeta.channelEncodings {
+			if ic.isupport.CaseMapping(name) == channel {
+				return encodings
+			}
+		}
+	}
+	return ic.NetMeta.encodings
+}
+
+// mayBeISO2022 checks if the text contains ISO-2022 designation escapes. ISO-2022 is a 7-bit encoding,
+// so text in it is always valid UTF-8 and must be checked for separately.
+func mayBeISO2022(text string) bool {
+	return strings.Contains(text, "\x1b$") || strings.Contains(text, "\x1b(")
+}
+
+// tryDecode decodes the text with the given encoding and returns false if the text contained invalid bytes.
+func tryDecode(enc encoding.Encoding, text string) (string, bool) {
+	decoded, err := enc.NewDecoder().String(text)
+	return decoded, err == nil && !strings.ContainsRune(decoded, utf8.RuneError)
+}
+
+// decodeText converts incoming text to UTF-8. Text that is already valid UTF-8 is returned as-is,
+// otherwise the encodings of the channel are tried in order until one decodes the text cleanly.
+func (ic *IRCClient) decodeText(channel, text string) string {
+	encodings := ic.getEncodings(channel)
+	if utf8.ValidString(text) {
+		if mayBeISO2022(text) && slices.Contains(encodings, japanese.ISO2022JP) {
+			if decoded, ok := tryDecode(japanese.ISO2022JP, text); ok {
+				return decoded
+			}
+		}
+		return text
+	} else if ic.isupport.UTF8Only {
+		return strings.ToValidUTF8(text, string(utf8.RuneError))
+	} else if len(encodings) == 0 {
+		encodings = defaultFallbackEncodings
+	}
+	for _, enc := range encodings {
+		if enc == unicode.UTF8 {
+			// UTF-8 was already checked above
+			continue
+		} else if decoded, ok := tryDecode(enc, text); ok {
+			return decoded
+		}
+	}
+	return strings.ToValidUTF8(text, string(utf8.RuneError))
+}
+
+// encodeText converts outgoing text to the primary encoding of the channel.
+// Characters that can't be represented in the encoding are replaced.
+func (ic *IRCClient) encodeText(channel, text string) string {
+	encodings := ic.getEncodings(channel)
+	if len(encodings) == 0 || encodings[0] == unicode.UTF8 {
+		return text
+	}
+	encoded, err := encoding.ReplaceUnsupported(encodings[0].NewEncoder()).String(text)
+	if err != nil {
+		ic.UserLogin.Log.Warn().Err(err).Str("channel", channel).Msg("Failed to encode outgoing text")
+		return text
+	}
+	return encoded
+}
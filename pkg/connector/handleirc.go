@@ -19,6 +19,7 @@ package connector
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -39,16 +40,34 @@ import (
 )
 
 func (ic *IRCClient) onConnect(msg ircmsg.Message) {
-	ic.UserLogin.RemoteName = fmt.Sprintf("%s on %s", ic.Conn.CurrentNick(), ic.NetMeta.DisplayName)
-	ic.UserLogin.RemoteProfile.Name = ic.Conn.CurrentNick()
+	ic.updateRemoteProfile()
 	ic.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	ic.notifyConnectResult(nil)
 	ic.isupport = ParseISupport(ic.Conn.ISupport())
+	ic.resetRoomFeatures()
 	ic.UserLogin.Log.Trace().Any("evt", msg).Msg("Connected to network")
-	for _, ch := range ic.UserLogin.Metadata.(*UserLoginMetadata).Channels {
-		err := ic.Conn.Join(ch)
+	ic.resetLag()
+	ic.restoreOwnAway()
+	go ic.startMonitoring()
+	go func() {
+		// Migrate before joining, so that the member lists of the channels use the new IDs
+		ic.migrateCasemapping(ic.UserLogin.Log.WithContext(ic.Main.Bridge.BackgroundCtx))
+		ic.joinAutojoinChannels()
+	}()
+}
+
+// joinAutojoinChannels joins the channels on the autojoin list. Multiple channels are joined with one
+// command if the server's TARGMAX allows it, otherwise each channel is joined separately.
+func (ic *IRCClient) joinAutojoinChannels() {
+	maxTargets, multiTarget := ic.isupport.TargMax["JOIN"]
+	if !multiTarget {
+		maxTargets = 1
+	}
+	for _, batch := range batchTargets(ic.UserLogin.Metadata.(*UserLoginMetadata).Channels, ",", maxTargets) {
+		err := ic.Conn.Join(strings.Join(batch, ","))
 		if err != nil {
-			ic.UserLogin.Log.Err(err).Str("channel_name", ch).
-				Msg("Failed to auto-join channel")
+			ic.UserLogin.Log.Err(err).Strs("channel_names", batch).
+				Msg("Failed to auto-join channels")
 			break
 		}
 	}
@@ -57,35 +76,17 @@ func (ic *IRCClient) onConnect(msg ircmsg.Message) {
 func (ic *IRCClient) onWelcome(message ircmsg.Message) {
 	if message.Command == ircevent.RPL_WELCOME {
 		ic.motdBuilder.Reset()
-		//ic.motdBuilder.WriteString("<pre>")
 	}
 	ic.motdBuilder.WriteString(ircfmt.ParseASCII(strings.Join(message.Params[1:], " ")))
-	if message.Command == ircevent.RPL_ENDOFMOTD {
-		//ic.motdBuilder.WriteString("</pre>")
-		fmt.Println("Finished building motd")
-		log := ic.UserLogin.Log.With().Str("action", "end of motd").Logger()
-		ctx := log.WithContext(ic.Main.Bridge.BackgroundCtx)
-		mgmtRoom, err := ic.UserLogin.User.GetManagementRoom(ctx)
-		if err != nil {
-			log.Err(err).Msg("Failed to get management room")
-		}
-		motd := &event.MessageEventContent{
+	if message.Command == ircevent.RPL_ENDOFMOTD || message.Command == ircevent.ERR_NOMOTD {
+		ic.sendStatusMessage(message, &event.MessageEventContent{
 			MsgType:       event.MsgNotice,
 			Body:          format.HTMLToText(ic.motdBuilder.String()),
 			Format:        event.FormatHTML,
 			FormattedBody: ic.motdBuilder.String(),
-			Mentions:      &event.Mentions{},
-		}
-		_, err = ic.Main.Bridge.Bot.SendMessage(ctx, mgmtRoom, event.EventMessage, &event.Content{
-			Parsed: motd,
-		}, &bridgev2.MatrixSendExtra{
-			Timestamp: getTimeTag(message),
 		})
-		if err != nil {
-			log.Err(err).Msg("Failed to send MOTD to management room")
-		}
+		ic.motdBuilder.Reset()
 	} else {
-		//ic.motdBuilder.WriteByte('\n')
 		ic.motdBuilder.WriteString("<br>")
 	}
 }
@@ -113,35 +114,46 @@ func (ic *IRCClient) onBatch(batch *ircevent.Batch) bool {
 }
 
 func (ic *IRCClient) onNick(msg ircmsg.Message) {
-	ic.chatInfoCacheLock.Lock()
-	defer ic.chatInfoCacheLock.Unlock()
 	prevNick := msg.Nick()
 	newNick := msg.Params[0]
 	if prevNick == "" || newNick == "" {
 		return
 	}
-	// TODO transfer DM portals? (need to be careful about security)
+	if ic.isupport.CaseMapping(newNick) == ic.isupport.CaseMapping(ic.Conn.CurrentNick()) {
+		// The connection updates the current nick before calling the handlers
+		ic.onOwnNickChange(newNick)
+	}
+	prevSender := ic.makeGhostOnlyEventSender(prevNick)
+	account := ic.moveUser(prevNick, newNick).Account
+	if hasAccountTag, taggedAccount := msg.GetTag("account"); hasAccountTag {
+		account = taggedAccount
+		ic.setAccount(newNick, account)
+	}
+	newSender := ic.makeGhostOnlyEventSender(newNick)
+	if account != "" && ic.useAccountGhosts() {
+		// The account proves that it's the same person, so the DM can safely follow the nick
+		log := ic.UserLogin.Log.With().
+			Str("action", "nick change").
+			Str("prev_nick", prevNick).
+			Str("new_nick", newNick).
+			Logger()
+		ic.transferDMPortal(log.WithContext(ic.Main.Bridge.BackgroundCtx), prevNick, newNick)
+		ic.addMonitorTargets(newNick)
+	}
+	ic.chatInfoCacheLock.Lock()
+	defer ic.chatInfoCacheLock.Unlock()
 	for ch := range ic.unlockedFindChannelsOfMember(prevNick) {
 		delete(ch.Meta.Members, prevNick)
 		ch.Meta.Members[newNick] = ch.PowerLevel
-		mm := bridgev2.ChatMemberMap{}
-		mm.Set(bridgev2.ChatMember{
-			EventSender: ic.makeGhostOnlyEventSender(prevNick),
-			Membership:  event.MembershipLeave,
-			PowerLevel:  ptr.Ptr(0),
-			MemberEventExtra: map[string]any{
-				"reason": fmt.Sprintf("Changed nick to %s", newNick),
-			},
-			PrevMembership: event.MembershipJoin,
-		})
-		mm.Set(bridgev2.ChatMember{
-			EventSender: ic.makeGhostOnlyEventSender(newNick),
-			Membership:  event.MembershipJoin,
-			PowerLevel:  ptr.Ptr(ch.PowerLevel),
-			MemberEventExtra: map[string]any{
-				"reason": fmt.Sprintf("Changed nick from %s", prevNick),
-			},
-		})
+		if prevSender.Sender != newSender.Sender {
+			ic.queueGhostSwap(
+				msg, "nick change", ch, prevSender, newSender,
+				fmt.Sprintf("Changed nick to %s", newNick),
+				fmt.Sprintf("Changed nick from %s", prevNick),
+			)
+			continue
+		}
+		// The ghost is the same (i.e. it's based on the account), so only the displayname needs to be updated
 		ic.UserLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
 			EventMeta: simplevent.EventMeta{
 				Type: bridgev2.RemoteEventChatInfoChange,
@@ -153,7 +165,12 @@ func (ic *IRCClient) onNick(msg ircmsg.Message) {
 			},
 			ChatInfoChange: &bridgev2.ChatInfoChange{
 				MemberChanges: &bridgev2.ChatMemberList{
-					MemberMap: mm,
+					MemberMap: bridgev2.ChatMemberMap{}.Set(bridgev2.ChatMember{
+						EventSender: newSender,
+						Membership:  event.MembershipJoin,
+						PowerLevel:  ptr.Ptr(ch.PowerLevel),
+						UserInfo:    ic.getUserInfo(newNick),
+					}),
 				},
 			},
 		})
@@ -198,6 +215,7 @@ func (ic *IRCClient) onQuit(msg ircmsg.Message) {
 			},
 		})
 	}
+	ic.removeUser(nick)
 }
 
 func (ic *IRCClient) onJoinPart(msg ircmsg.Message) {
@@ -205,9 +223,13 @@ func (ic *IRCClient) onJoinPart(msg ircmsg.Message) {
 		// Let the names handler deal with self-joins
 		return
 	}
+	isOwnPart := msg.Command == "PART" && msg.Nick() == ic.Conn.CurrentNick()
 	ic.chatInfoCacheLock.Lock()
 	info, ok := ic.chatInfoCache[msg.Params[0]]
-	if ok {
+	if ok && isOwnPart {
+		// The bridge won't be told about changes to the members anymore
+		delete(ic.chatInfoCache, msg.Params[0])
+	} else if ok {
 		if msg.Command == "JOIN" {
 			info.Members[msg.Nick()] = 0
 		} else {
@@ -241,13 +263,86 @@ func (ic *IRCClient) onJoinPart(msg ircmsg.Message) {
 			},
 		},
 	})
+	if isOwnPart && ok {
+		for nick := range info.Members {
+			ic.pruneUser(nick)
+		}
+	} else if msg.Command == "PART" {
+		ic.pruneUser(msg.Nick())
+	}
+}
+
+func (ic *IRCClient) onJoinError(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	channel := msg.Params[1]
+	if ic.resolveJoinError(channel, msg) {
+		// The join was requested by a command, which will report the error itself
+		return
+	} else if !ic.isAutojoinChannel(channel) {
+		// Some of the numerics are also replies to other commands like PART and MODE
+		return
+	}
+	ic.UserLogin.Log.Warn().
+		Str("channel", channel).
+		Str("numeric", msg.Command).
+		Str("error", msg.Params[len(msg.Params)-1]).
+		Msg("Failed to join channel")
+	ic.sendNotice(
+		ic.Main.Bridge.BackgroundCtx, "",
+		fmt.Sprintf("Failed to join %s: %s", format.SafeMarkdownCode(channel), (&IRCError{Msg: &msg}).HumanMessage()),
+		getTimeTag(msg),
+	)
+}
+
+// isAutojoinChannel returns true if the channel is on the autojoin list of the login.
+func (ic *IRCClient) isAutojoinChannel(channel string) bool {
+	mappedChannel := ic.isupport.CaseMapping(channel)
+	return slices.ContainsFunc(ic.UserLogin.Metadata.(*UserLoginMetadata).Channels, func(ch string) bool {
+		return ic.isupport.CaseMapping(ch) == mappedChannel
+	})
 }
 
-func (ic *IRCClient) onMode(msg ircmsg.Message) {
-	if ic.isDM(msg.Params[0]) {
+func (ic *IRCClient) onLinkChannel(msg ircmsg.Message) {
+	if len(msg.Params) < 3 {
+		return
+	}
+	origChannel, newChannel := msg.Params[1], msg.Params[2]
+	if ic.resolveJoinError(origChannel, msg) {
 		return
 	}
-	// TODO
+	ctx := ic.UserLogin.Log.With().Str("action", "channel forward").Logger().WithContext(ic.Main.Bridge.BackgroundCtx)
+	ic.recordChannelForward(ctx, origChannel, newChannel)
+	ic.sendNotice(ctx, "", fmt.Sprintf(
+		"%s forwarded you to %s, your autojoin list has been updated",
+		format.SafeMarkdownCode(origChannel), format.SafeMarkdownCode(newChannel),
+	), getTimeTag(msg))
+}
+
+// recordChannelForward replaces the original channel with the one the server forwarded us to
+// in the autojoin list, so that the next connection doesn't get forwarded again.
+func (ic *IRCClient) recordChannelForward(ctx context.Context, origChannel, newChannel string) {
+	zerolog.Ctx(ctx).Info().
+		Str("orig_channel", origChannel).
+		Str("new_channel", newChannel).
+		Msg("Join was forwarded to another channel")
+	meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+	mappedOrig := ic.isupport.CaseMapping(origChannel)
+	mappedNew := ic.isupport.CaseMapping(newChannel)
+	hasNew := slices.ContainsFunc(meta.Channels, func(ch string) bool {
+		return ic.isupport.CaseMapping(ch) == mappedNew
+	})
+	meta.Channels = slices.DeleteFunc(meta.Channels, func(ch string) bool {
+		return ic.isupport.CaseMapping(ch) == mappedOrig
+	})
+	if !hasNew {
+		meta.Channels = append(meta.Channels, newChannel)
+	}
+	err := ic.UserLogin.Save(ctx)
+	if err != nil {
+		zerolog.Ctx(ctx).Err(err).Msg("Failed to save login after updating autojoin channels")
+	}
 }
 
 func getTimeTag(msg ircmsg.Message) time.Time {
@@ -269,12 +364,15 @@ func (ic *IRCClient) onMessage(msg ircmsg.Message) {
 		return
 	}
 	senderNick := msg.Nick()
-	targetChannel := msg.Params[0]
+	// Messages sent only to channel members with a specific prefix (e.g. @#channel) go to the normal channel portal
+	targetChannel := ic.isupport.StripStatusMsg(msg.Params[0])
 	if senderNick == "" || strings.ContainsRune(senderNick, '.') || targetChannel == "*" {
-		// TODO maybe do something with these
+		// Server notices and messages sent before registration
+		ic.onStatusMessage(msg)
 		return
 	} else if ic.isDM(targetChannel) {
 		targetChannel = senderNick
+		ic.addMonitorTargets(senderNick)
 	}
 	_, canRelay := ic.Conn.AcknowledgedCaps()["draft/relaymsg"]
 	_, relaySourceNick := msg.GetTag("draft/relaymsg")
@@ -353,7 +451,8 @@ func (ic *IRCClient) convertMessage(
 	intent bridgev2.MatrixAPI,
 	data *WrappedMessage,
 ) (*bridgev2.ConvertedMessage, error) {
-	content := ircfmt.ASCIIToContent(data.Params[1])
+	channel, _ := ic.parsePortalID(portal.ID)
+	content := ircfmt.ASCIIToContent(ic.decodeText(channel, data.Params[1]))
 	if data.Command == "NOTICE" {
 		content.MsgType = event.MsgNotice
 	} else if data.Command == "CTCP_ACTION" {
@@ -409,22 +508,42 @@ func (ic *IRCClient) onUsers(message ircmsg.Message) {
 }
 
 func (ic *IRCClient) onUsersEnd(message ircmsg.Message) {
+	channel := message.Params[1]
 	ic.chatInfoCacheLock.Lock()
-	defer ic.chatInfoCacheLock.Unlock()
-	info, ok := ic.chatInfoCache[message.Params[1]]
+	info, ok := ic.chatInfoCache[channel]
+	if ok {
+		info.MembersComplete = true
+	}
+	ic.chatInfoCacheLock.Unlock()
 	if !ok {
 		return
 	}
-	info.MembersComplete = true
+	if ic.useAccountGhosts() && ic.isupport.WHOX {
+		// NAMES doesn't include accounts, so fetch them before syncing members to get the right ghosts
+		err := ic.fetchChannelAccounts(channel, message)
+		if err == nil {
+			return
+		}
+		ic.UserLogin.Log.Err(err).Str("channel", channel).Msg("Failed to request accounts of channel members")
+	}
+	ic.queueChannelResync(channel, message)
+}
+
+func (ic *IRCClient) queueChannelResync(channel string, source ircmsg.Message) {
+	ic.chatInfoCacheLock.RLock()
+	if info, ok := ic.chatInfoCache[channel]; ok {
+		ic.resolveJoinSuccess(channel, info.Members)
+	}
+	ic.chatInfoCacheLock.RUnlock()
 	ic.UserLogin.QueueRemoteEvent(&simplevent.ChatResync{
 		EventMeta: simplevent.EventMeta{
 			Type: bridgev2.RemoteEventChatResync,
 			LogContext: func(c zerolog.Context) zerolog.Context {
-				return c.Str("source", message.Source).Str("action", "users end resync")
+				return c.Str("source", source.Source).Str("action", "users end resync")
 			},
-			PortalKey:    ic.makePortalKey(message.Params[1]),
+			PortalKey:    ic.makePortalKey(channel),
 			CreatePortal: true,
-			Timestamp:    getTimeTag(message),
+			Timestamp:    getTimeTag(source),
 		},
 		GetChatInfoFunc: ic.GetChatInfo,
 	})
@@ -433,12 +552,13 @@ func (ic *IRCClient) onUsersEnd(message ircmsg.Message) {
 func (ic *IRCClient) onOldTopic(message ircmsg.Message) {
 	ic.chatInfoCacheLock.Lock()
 	defer ic.chatInfoCacheLock.Unlock()
-	ic.unlockedGetOrCreateChatInfo(message.Params[1]).Topic = message.Params[2]
+	ic.unlockedGetOrCreateChatInfo(message.Params[1]).Topic = ic.decodeText(message.Params[1], message.Params[2])
 }
 
 func (ic *IRCClient) onNewTopic(message ircmsg.Message) {
+	topic := ic.decodeText(message.Params[0], message.Params[1])
 	ic.chatInfoCacheLock.Lock()
-	ic.unlockedGetOrCreateChatInfo(message.Params[0]).Topic = message.Params[1]
+	ic.unlockedGetOrCreateChatInfo(message.Params[0]).Topic = topic
 	ic.chatInfoCacheLock.Unlock()
 	ic.UserLogin.QueueRemoteEvent(&simplevent.ChatInfoChange{
 		EventMeta: simplevent.EventMeta{
@@ -452,7 +572,7 @@ func (ic *IRCClient) onNewTopic(message ircmsg.Message) {
 		},
 		ChatInfoChange: &bridgev2.ChatInfoChange{
 			ChatInfo: &bridgev2.ChatInfo{
-				Topic: ptr.Ptr(message.Params[1]),
+				Topic: ptr.Ptr(topic),
 			},
 		},
 	})
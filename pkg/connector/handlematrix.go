@@ -43,15 +43,31 @@ var (
 	_ bridgev2.MembershipHandlingNetworkAPI = (*IRCClient)(nil)
 )
 
-type sendWaiter struct {
-	ch  chan *ircmsg.Message
-	cmd string
-}
-
 var (
 	ErrNoPublicMedia = bridgev2.WrapErrorInStatus(errors.New("matrix connector doesn't support public media")).WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusUnsupported)
 )
 
+func makeTooLongError(what string, length, limit int) error {
+	return bridgev2.WrapErrorInStatus(fmt.Errorf("%s is too long (%d/%d bytes)", what, length, limit)).
+		WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusGenericError)
+}
+
+const (
+	// Servers don't advertise the maximum length of user@host, so assume the common USERLEN and HOSTLEN
+	maxUserLen = 10
+	maxHostLen = 63
+)
+
+// maxMessageLength returns the maximum number of bytes that can be sent as the text of a message,
+// so that the line relayed to other users (including the nick!user@host prefix) fits in LINELEN.
+func (ic *IRCClient) maxMessageLength(nick, cmd, target string) int {
+	// :nick!user@host CMD target :text\r\n
+	relayOverhead := 1 + len(nick) + 1 + maxUserLen + 1 + maxHostLen + 1 + len(cmd) + 1 + len(target) + 2 + 2
+	// The outgoing line doesn't have a prefix, but ircevent won't send lines over MaxLineLen
+	ownOverhead := len(cmd) + 1 + len(target) + 2 + 2
+	return min(ic.isupport.LineLen-relayOverhead, ic.Conn.MaxLineLen-ownOverhead)
+}
+
 const specialChars = `!+%@&#$:'"?*,. `
 
 func filterPerMessageName(nick string) string {
@@ -64,6 +80,12 @@ func (ic *IRCClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return nil, err
+	} else if channel == statusChannel {
+		return ic.handleStatusInput(ctx, msg)
+	} else if line, ok := ic.getPassthroughCommand(msg); ok {
+		return ic.handlePassthroughCommand(ctx, channel, line)
+	} else if ic.isDM(channel) && ic.isKnownOffline(channel) {
+		return nil, makeOfflineError(ic.casemappedNames.GetDefault(channel, channel))
 	}
 	body := ircfmt.ContentToASCII(ctx, msg.Content)
 	if msg.Content.MsgType.IsMedia() {
@@ -80,12 +102,14 @@ func (ic *IRCClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 		}
 		body += fmt.Sprintf("<%s>", url)
 	}
+	body = ic.encodeText(channel, body)
 	cmd := "PRIVMSG"
 	var waiterCmd string
 	if msg.Content.MsgType == event.MsgNotice {
 		cmd = "NOTICE"
 	} else if msg.Content.MsgType == event.MsgEmote {
-		body = fmt.Sprintf("\x01ACTION %s\x01", body)
+		// CTCP messages can't be split into multiple lines
+		body = fmt.Sprintf("\x01ACTION %s\x01", strings.ReplaceAll(body, "\n", " "))
 		waiterCmd = "CTCP_ACTION"
 	}
 	tags := make(map[string]string)
@@ -114,9 +138,18 @@ func (ic *IRCClient) HandleMatrixMessage(ctx context.Context, msg *bridgev2.Matr
 		if relayChar != "" {
 			relayChar = "m" + relayChar
 		}
+		body = strings.ReplaceAll(body, "\n", " ")
+		if maxLength := ic.maxMessageLength(relayChar+overrideNick, "PRIVMSG", channel); len(body) > maxLength {
+			return nil, makeTooLongError("message", len(body), maxLength)
+		}
 		resp, err = ic.SendRequest(ctx, tags, "", "RELAYMSG", channel, relayChar+overrideNick, body)
-	} else {
+	} else if waiterCmd != "" {
+		if maxLength := ic.maxMessageLength(ic.Conn.CurrentNick(), cmd, channel); len(body) > maxLength {
+			return nil, makeTooLongError("message", len(body), maxLength)
+		}
 		resp, err = ic.SendRequest(ctx, tags, waiterCmd, cmd, channel, body)
+	} else {
+		resp, err = ic.sendText(ctx, tags, cmd, channel, body)
 	}
 	if err != nil {
 		return nil, err
@@ -135,9 +168,11 @@ func (ic *IRCClient) PreHandleMatrixReaction(ctx context.Context, msg *bridgev2.
 	if !canTag {
 		return bridgev2.MatrixReactionPreResponse{}, fmt.Errorf("server does not support message-tags")
 	}
-	_, err := ic.parsePortalID(msg.Portal.ID)
+	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return bridgev2.MatrixReactionPreResponse{}, err
+	} else if channel == statusChannel {
+		return bridgev2.MatrixReactionPreResponse{}, ErrStatusRoomUnsupported
 	}
 	_, msgID := parseProperMessageID(msg.TargetMessage.ID)
 	if msgID == "" {
@@ -155,6 +190,8 @@ func (ic *IRCClient) HandleMatrixReaction(ctx context.Context, msg *bridgev2.Mat
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return nil, err
+	} else if channel == statusChannel {
+		return nil, ErrStatusRoomUnsupported
 	}
 	_, msgID := parseProperMessageID(msg.TargetMessage.ID)
 	if msgID == "" {
@@ -185,6 +222,8 @@ func (ic *IRCClient) HandleMatrixReactionRemove(ctx context.Context, msg *bridge
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return err
+	} else if channel == statusChannel {
+		return ErrStatusRoomUnsupported
 	}
 	msgID := msg.TargetReaction.Metadata.(*ReactionMetadata).MessageID
 	if msgID == "" {
@@ -205,6 +244,8 @@ func (ic *IRCClient) HandleMatrixMessageRemove(ctx context.Context, msg *bridgev
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return err
+	} else if channel == statusChannel {
+		return ErrStatusRoomUnsupported
 	}
 	_, msgID := parseProperMessageID(msg.TargetMessage.ID)
 	if msgID == "" {
@@ -221,6 +262,8 @@ func (ic *IRCClient) HandleMatrixTyping(ctx context.Context, msg *bridgev2.Matri
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return err
+	} else if channel == statusChannel {
+		return nil
 	}
 	_, canTag := ic.Conn.AcknowledgedCaps()["message-tags"]
 	if !canTag {
@@ -240,13 +283,19 @@ func (ic *IRCClient) HandleMatrixRoomTopic(ctx context.Context, msg *bridgev2.Ma
 	channel, err := ic.parsePortalID(msg.Portal.ID)
 	if err != nil {
 		return false, err
+	} else if channel == statusChannel {
+		return false, fmt.Errorf("the status room doesn't have a topic on IRC")
 	}
-	resp, err := ic.SendRequest(ctx, nil, "", "TOPIC", channel, msg.Content.Topic)
+	topic := ic.encodeText(channel, msg.Content.Topic)
+	if ic.isupport.TopicLen > 0 && len(topic) > ic.isupport.TopicLen {
+		return false, makeTooLongError("topic", len(topic), ic.isupport.TopicLen)
+	}
+	resp, err := ic.SendRequest(ctx, nil, "", "TOPIC", channel, topic)
 	if err != nil {
 		return false, err
 	}
-	msg.Portal.Topic = resp.Params[1]
-	msg.Portal.TopicSet = msg.Content.Topic == resp.Params[1]
+	msg.Portal.Topic = ic.decodeText(channel, resp.Params[1])
+	msg.Portal.TopicSet = msg.Content.Topic == msg.Portal.Topic
 	return true, nil
 }
 
@@ -262,8 +311,8 @@ func (ic *IRCClient) HandleMatrixMembership(ctx context.Context, msg *bridgev2.M
 		channel, err := ic.parsePortalID(msg.Portal.ID)
 		if err != nil {
 			return nil, err
-		} else if ic.isDM(channel) {
-			// Leaving DMs is a no-op
+		} else if channel == statusChannel || ic.isDM(channel) {
+			// Leaving DMs and the status room is a no-op
 			return nil, nil
 		}
 		meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
@@ -278,6 +327,9 @@ func (ic *IRCClient) HandleMatrixMembership(ctx context.Context, msg *bridgev2.M
 		}
 		return nil, nil
 	default:
+		if channel, err := ic.parsePortalID(msg.Portal.ID); err == nil && channel == statusChannel {
+			return nil, ErrStatusRoomUnsupported
+		}
 		return nil, fmt.Errorf("unsupported membership change")
 	}
 }
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/ergochat/irc-go/ircmsg"
+	"go.mau.fi/util/random"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 	"maunium.net/go/mautrix/id"
@@ -63,6 +64,12 @@ func makeMessageID(netName string, msg *ircmsg.Message) networkid.MessageID {
 	return networkid.MessageID(fmt.Sprintf("%s:hash:%s:%s:%d:%x", netName, msg.Params[0], msg.Source, approxTime, hash[:16]))
 }
 
+// makeLocalMessageID returns a random message ID for messages that only exist on Matrix,
+// like server messages in the status room and commands that aren't sent as messages.
+func (ic *IRCClient) makeLocalMessageID() networkid.MessageID {
+	return networkid.MessageID(fmt.Sprintf("%s:local:%s", ic.NetMeta.Name, random.String(16)))
+}
+
 func parseProperMessageID(msgID networkid.MessageID) (netName, realID string) {
 	parts := strings.SplitN(string(msgID), ":", 3)
 	netName = parts[0]
@@ -110,17 +117,36 @@ func (ic *IRCClient) makePortalKey(channel string) (key networkid.PortalKey) {
 
 func (ic *IRCClient) IsThisUser(ctx context.Context, userID networkid.UserID) bool {
 	netName, nick, err := parseUserID(userID)
+	if err != nil || netName != ic.NetMeta.Name {
+		return false
+	}
 	currentNick := ic.Conn.CurrentNick()
 	if currentNick == "" {
 		currentNick = ic.Conn.PreferredNick()
 	}
-	return err == nil && netName == ic.NetMeta.Name && nick == ic.isupport.CaseMapping(currentNick)
+	if mappedAccount, isAccount := strings.CutPrefix(nick, accountIDPrefix); isAccount {
+		ownAccount := ic.getAccount(currentNick)
+		return ownAccount != "" && ic.isupport.CaseMapping(ownAccount) == mappedAccount
+	}
+	return nick == ic.isupport.CaseMapping(currentNick)
 }
 
 func validateIdentifier(name string) bool {
 	return !strings.ContainsRune(name, ' ') && !strings.HasPrefix(name, ":")
 }
 
+// validateNick checks that the nick is valid according to the usual nick rules and the server's NICKLEN.
+func (ic *IRCClient) validateNick(nick string) error {
+	if nick == "" ||
+		strings.ContainsAny(nick, " ,*?!@:") ||
+		strings.ContainsAny(nick[:1], ic.isupport.ChanTypes+ic.isupport.StatusMsg+"$-0123456789") {
+		return fmt.Errorf("%w %q", ErrInvalidNick, nick)
+	} else if ic.isupport.NickLen > 0 && len(nick) > ic.isupport.NickLen {
+		return fmt.Errorf("%w %q: longer than %d characters", ErrInvalidNick, nick, ic.isupport.NickLen)
+	}
+	return nil
+}
+
 func parseUserID(userID networkid.UserID) (netName, nick string, err error) {
 	parts := strings.SplitN(string(userID), "_", 2)
 	if len(parts) != 2 || !validateIdentifier(parts[1]) {
@@ -131,6 +157,7 @@ func parseUserID(userID networkid.UserID) (netName, nick string, err error) {
 }
 
 var (
+	ErrInvalidNick           = errors.New("invalid nick")
 	ErrNameNotCasemapped     = errors.New("name is not properly casemapped")
 	ErrInvalidUserIDFormat   = errors.New("invalid user ID format")
 	ErrInvalidPortalIDFormat = errors.New("invalid portal ID format")
@@ -156,15 +183,46 @@ func (ic *IRCClient) validateName(netName, name string) error {
 	return nil
 }
 
+// accountIDPrefix is prepended to account names in user IDs.
+// Nicks can't contain @, so account-based IDs never collide with nick-based ones.
+const accountIDPrefix = "@"
+
 func (ic *IRCClient) makeUserID(nick string) networkid.UserID {
+	return ic.makeUserIDWithAccount(nick, ic.getAccount(nick))
+}
+
+// makeUserIDWithAccount returns the user ID for the given nick. If account ghosts are enabled and the user
+// is logged in, the ID is based on the account name instead, so that it stays the same across nick changes.
+func (ic *IRCClient) makeUserIDWithAccount(nick, account string) networkid.UserID {
 	if nick == "" {
 		return ""
 	}
 	mappedNick := ic.isupport.CaseMapping(nick)
 	ic.casemappedNames.Set(mappedNick, nick)
+	if account != "" && ic.useAccountGhosts() {
+		return networkid.UserID(fmt.Sprintf("%s_%s%s", ic.NetMeta.Name, accountIDPrefix, ic.isupport.CaseMapping(account)))
+	}
 	return networkid.UserID(fmt.Sprintf("%s_%s", ic.NetMeta.Name, mappedNick))
 }
 
+// resolveUserID returns the current nick of the user with the given ID. For account-based IDs,
+// someone must be logged into the account on a nick that the bridge has seen.
+func (ic *IRCClient) resolveUserID(userID networkid.UserID) (string, error) {
+	name, err := ic.parseUserID(userID)
+	if err != nil {
+		return "", err
+	}
+	mappedAccount, isAccount := strings.CutPrefix(name, accountIDPrefix)
+	if !isAccount {
+		return ic.casemappedNames.GetDefault(name, name), nil
+	}
+	nick, ok := ic.findNickByAccount(mappedAccount)
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrAccountNotOnline, mappedAccount)
+	}
+	return nick, nil
+}
+
 func (ic *IRCClient) makeGhostOnlyEventSender(nick string) bridgev2.EventSender {
 	return bridgev2.EventSender{
 		Sender: ic.makeUserID(nick),
@@ -1,4 +1,4 @@
--- v0 -> v1 (compatible with v1+): Latest schema
+-- v0 -> v2 (compatible with v1+): Latest schema
 CREATE TABLE irc_ident(
     -- only: postgres
     rowid BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
@@ -10,3 +10,8 @@ CREATE TABLE irc_ident(
     CONSTRAINT irc_ident_mxid_unique UNIQUE (mxid),
     CONSTRAINT irc_ident_ident_unique UNIQUE (ident)
 );
+
+CREATE TABLE irc_network(
+    name        TEXT NOT NULL PRIMARY KEY,
+    casemapping TEXT NOT NULL
+);
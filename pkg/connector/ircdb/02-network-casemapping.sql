@@ -0,0 +1,5 @@
+-- v2 (compatible with v1+): Store last seen casemapping of networks
+CREATE TABLE irc_network(
+    name        TEXT NOT NULL PRIMARY KEY,
+    casemapping TEXT NOT NULL
+);
@@ -0,0 +1,41 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ircdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// GetCasemapping returns the casemapping that the network used the last time it was connected to,
+// or an empty string if it hasn't been stored yet.
+func (db *IRCDB) GetCasemapping(ctx context.Context, network string) (casemapping string, err error) {
+	err = db.QueryRow(ctx, "SELECT casemapping FROM irc_network WHERE name=$1", network).Scan(&casemapping)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (db *IRCDB) SetCasemapping(ctx context.Context, network, casemapping string) error {
+	_, err := db.Exec(ctx, `
+		INSERT INTO irc_network (name, casemapping) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET casemapping=excluded.casemapping
+	`, network, casemapping)
+	return err
+}
@@ -19,38 +19,41 @@ package connector
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ergochat/irc-go/ircevent"
 	"github.com/ergochat/irc-go/ircmsg"
 	"github.com/pkg/errors"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/status"
+	"maunium.net/go/mautrix/event"
 )
 
 func (ic *IRCClient) onDisconnect(message ircmsg.Message) {
-	ic.sendWaitersLock.Lock()
-	defer ic.sendWaitersLock.Unlock()
-	for _, waiter := range ic.sendWaiters {
-		close(waiter.ch)
-	}
-	clear(ic.sendWaiters)
+	ic.sendWaiters.CloseAll()
+	ic.clearUsers()
+	ic.clearChannelAccountQueries()
+	ic.stopMonitoring()
+	ic.ownAwayLock.Lock()
+	ic.preAwaySent = false
+	ic.ownAwayLock.Unlock()
 }
 
 func (ic *IRCClient) onPotentialEchoMessage(msg ircmsg.Message) bool {
 	if msg.Nick() != ic.Conn.CurrentNick() {
 		return false
 	}
-	ic.sendWaitersLock.Lock()
-	waiter, ok := ic.sendWaiters[msg.Params[0]]
-	ok = ok && msg.Command == waiter.cmd
-	if ok {
-		delete(ic.sendWaiters, msg.Params[0])
-	}
-	ic.sendWaitersLock.Unlock()
-	if ok {
-		waiter.ch <- &msg
-		return true
+	return ic.sendWaiters.Resolve(ic.isupport.CaseMapping(msg.Params[0]), msg.Command, getEchoBody(msg.Params), &msg)
+}
+
+// getEchoBody returns the part of the parameters that is compared when matching responses to requests.
+func getEchoBody(params []string) string {
+	if len(params) < 2 {
+		return ""
 	}
-	return false
+	return params[len(params)-1]
 }
 
 type IRCError struct {
@@ -61,6 +64,109 @@ func (ie *IRCError) Error() string {
 	return fmt.Sprintf("%s: %s", ie.Msg.Command, ie.Msg.Params[len(ie.Msg.Params)-1])
 }
 
+type numericErrorMeta struct {
+	Reason  event.MessageStatusReason
+	Message string
+}
+
+// numericErrors contains human-readable messages for well-known error numerics.
+// The messages are also registered as bridge state errors with the irc- prefix.
+var numericErrors = map[string]numericErrorMeta{
+	ircevent.ERR_NOSUCHNICK:       {event.MessageStatusGenericError, "That user is not online"},
+	ircevent.ERR_NOSUCHCHANNEL:    {event.MessageStatusGenericError, "That channel doesn't exist"},
+	ircevent.ERR_CANNOTSENDTOCHAN: {event.MessageStatusNoPermission, "You can't send messages to this channel (you may be muted, not joined or need voice)"},
+	ircevent.ERR_TOOMANYCHANNELS:  {event.MessageStatusGenericError, "You have joined too many channels"},
+	ircevent.ERR_INPUTTOOLONG:     {event.MessageStatusGenericError, "The message is too long"},
+	ircevent.ERR_UNKNOWNCOMMAND:   {event.MessageStatusUnsupported, "The server doesn't support that command"},
+	ircevent.ERR_NOTONCHANNEL:     {event.MessageStatusNoPermission, "You're not in that channel"},
+	ircevent.ERR_CHANNELISFULL:    {event.MessageStatusNoPermission, "The channel is full"},
+	ircevent.ERR_INVITEONLYCHAN:   {event.MessageStatusNoPermission, "The channel is invite-only"},
+	ircevent.ERR_BANNEDFROMCHAN:   {event.MessageStatusNoPermission, "You're banned from the channel"},
+	ircevent.ERR_BADCHANNELKEY:    {event.MessageStatusNoPermission, "The channel requires a key"},
+	ircevent.ERR_NEEDREGGEDNICK:   {event.MessageStatusNoPermission, "You need a registered nick to do that"},
+	ircevent.ERR_CHANOPRIVSNEEDED: {event.MessageStatusNoPermission, "You're not a channel operator"},
+	"489":                         {event.MessageStatusNoPermission, "The channel requires a secure connection"},
+	"520":                         {event.MessageStatusNoPermission, "The channel is only open to IRC operators"},
+}
+
+func init() {
+	humanErrors := make(status.BridgeStateErrorMap, len(numericErrors))
+	for numeric, meta := range numericErrors {
+		humanErrors[numericErrorCode(numeric)] = meta.Message
+	}
+	status.BridgeStateHumanErrors.Update(humanErrors)
+}
+
+func numericErrorCode(numeric string) status.BridgeStateErrorCode {
+	return status.BridgeStateErrorCode("irc-" + numeric)
+}
+
+// HumanMessage returns a user-friendly description of the error.
+func (ie *IRCError) HumanMessage() string {
+	msg, ok := status.BridgeStateHumanErrors[numericErrorCode(ie.Msg.Command)]
+	if !ok {
+		return ie.Msg.Params[len(ie.Msg.Params)-1]
+	}
+	return msg
+}
+
+// humanizeError returns a user-friendly message for errors returned by SendRequest.
+func humanizeError(err error) string {
+	var ms bridgev2.MessageStatus
+	if errors.As(err, &ms) && ms.Message != "" {
+		return ms.Message
+	}
+	return err.Error()
+}
+
+// As allows the error to be converted into a bridgev2.MessageStatus with errors.As.
+func (ie *IRCError) As(target any) bool {
+	ms, ok := target.(*bridgev2.MessageStatus)
+	if !ok {
+		return false
+	}
+	meta, ok := numericErrors[ie.Msg.Command]
+	if !ok {
+		meta.Reason = event.MessageStatusGenericError
+	}
+	*ms = bridgev2.MessageStatus{
+		Status:      event.MessageStatusFail,
+		ErrorReason: meta.Reason,
+		Message:     ie.HumanMessage(),
+		IsCertain:   true,
+		SendNotice:  true,
+	}
+	return true
+}
+
+func makeStandardReplyError(msg *ircmsg.Message) error {
+	if reply := parseStandardReply(msg); reply != nil {
+		return reply
+	}
+	return &IRCError{Msg: msg}
+}
+
+// getLabeledResponse sends a command with a label and waits for the labeled response like
+// Conn.GetLabeledResponse, but stops waiting if the context is canceled. Late responses are dropped.
+func (ic *IRCClient) getLabeledResponse(ctx context.Context, tags map[string]string, cmd string, args ...string) (*ircevent.Batch, error) {
+	respCh := make(chan *ircevent.Batch, 1)
+	err := ic.Conn.SendWithLabel(func(batch *ircevent.Batch) {
+		respCh <- batch
+	}, tags, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case batch := <-respCh:
+		if batch == nil {
+			return nil, ircevent.NoLabeledResponse
+		}
+		return batch, nil
+	}
+}
+
 func (ic *IRCClient) SendRequest(ctx context.Context, tags map[string]string, waiterCmd, cmd string, args ...string) (*ircmsg.Message, error) {
 	channel := args[0]
 	labelResp, err := ic.Conn.GetLabeledResponse(tags, cmd, args...)
@@ -68,8 +174,11 @@ func (ic *IRCClient) SendRequest(ctx context.Context, tags map[string]string, wa
 		return nil, err
 	} else if labelResp != nil {
 		waiterCmd = cmd
-		if cmd == "RELAYMSG" {
+		switch cmd {
+		case "RELAYMSG":
 			waiterCmd = "PRIVMSG"
+		case "INVITE":
+			waiterCmd = ircevent.RPL_INVITING
 		}
 		if labelResp.Command == "BATCH" {
 			switch labelResp.Params[1] {
@@ -79,7 +188,8 @@ func (ic *IRCClient) SendRequest(ctx context.Context, tags map[string]string, wa
 				firstPart := labelResp.Items[0]
 				// This is a hack for service DM responses among other things
 				// First item in the batch is the echo message, the rest are the response from the bot
-				if firstPart.Command == waiterCmd && firstPart.Nick() == ic.Conn.CurrentNick() &&
+				isMessage := waiterCmd == "PRIVMSG" || waiterCmd == "NOTICE"
+				if isMessage && firstPart.Command == waiterCmd && firstPart.Nick() == ic.Conn.CurrentNick() &&
 					len(labelResp.Items) > 1 && labelResp.Items[1].Nick() != ic.Conn.CurrentNick() {
 					labelResp.Items = labelResp.Items[1:]
 					labelResp.Source = labelResp.Items[0].Source
@@ -88,12 +198,16 @@ func (ic *IRCClient) SendRequest(ctx context.Context, tags map[string]string, wa
 				}
 			}
 		}
-		if labelResp.Command != waiterCmd {
+		if labelResp.Command == "FAIL" {
+			return nil, makeStandardReplyError(&labelResp.Message)
+		} else if labelResp.Command != waiterCmd {
 			return nil, &IRCError{Msg: &labelResp.Message}
 		}
 		return &labelResp.Message, nil
 	}
-	if waiterCmd == "" {
+	if waiterCmd == "" && cmd == "INVITE" {
+		waiterCmd = ircevent.RPL_INVITING
+	} else if waiterCmd == "" {
 		waiterCmd = cmd
 	}
 	wrapped := ircmsg.MakeMessage(tags, "", cmd, args...)
@@ -102,34 +216,54 @@ func (ic *IRCClient) SendRequest(ctx context.Context, tags map[string]string, wa
 		// Some servers like libera are buggy and don't echo messages sent to services
 		willEcho = false
 	}
-	ch := make(chan *ircmsg.Message, 1)
+	var altTargets []string
+	switch cmd {
+	case "NICK", "SETNAME":
+		// Own nick and real name changes are always sent back to the client
+		willEcho = true
+	case "KICK", "INVITE":
+		// Kicks and invites are always answered, and errors can be about either the nick or the channel
+		willEcho = true
+		if len(args) > 1 {
+			altTargets = []string{ic.isupport.CaseMapping(args[1])}
+		}
+	}
+	echoBody := getEchoBody(args)
+	if waiterCmd == "CTCP_ACTION" {
+		echoBody = strings.TrimSuffix(strings.TrimPrefix(echoBody, "\x01ACTION "), "\x01")
+	}
+	// The waiter is registered even if no echo is expected to catch errors
+	waiter := ic.sendWaiters.Add(ic.isupport.CaseMapping(channel), cmd, waiterCmd, echoBody, altTargets...)
 	var timeoutCh <-chan time.Time
 	if willEcho {
-		ic.sendWaitersLock.Lock()
-		ic.sendWaiters[channel] = sendWaiter{ch: ch, cmd: waiterCmd}
-		ic.sendWaitersLock.Unlock()
 		timeoutCh = time.After(15 * time.Second)
 	} else {
 		timeoutCh = time.After(1 * time.Second)
 	}
 	err = ic.Conn.SendIRCMessage(wrapped)
 	if err != nil {
+		ic.sendWaiters.Remove(waiter)
 		return nil, err
 	}
 	select {
 	case <-ctx.Done():
+		ic.sendWaiters.Cancel(waiter)
 		return nil, ctx.Err()
-	case resp := <-ch:
+	case resp := <-waiter.ch:
 		if resp == nil {
 			return nil, fmt.Errorf("no echo received")
+		} else if resp.Command == "FAIL" {
+			return nil, makeStandardReplyError(resp)
 		} else if resp.Command != waiterCmd {
 			return nil, &IRCError{Msg: resp}
 		}
 		return resp, nil
 	case <-timeoutCh:
 		if willEcho {
+			ic.sendWaiters.Cancel(waiter)
 			return nil, fmt.Errorf("timeout waiting for echo message")
 		}
+		ic.sendWaiters.Remove(waiter)
 		// We're not waiting for an echo, which means the timeout is a success
 		return &wrapped, nil
 	}
@@ -139,32 +273,41 @@ func (ic *IRCClient) onFallbackReply(message ircmsg.Message) bool {
 	if len(message.Params) == 0 {
 		return false
 	}
-	ic.sendWaitersLock.Lock()
-	defer ic.sendWaitersLock.Unlock()
-	isError := message.Params[0] == ic.Conn.CurrentNick() &&
-		len(message.Command) == 3 &&
-		(message.Command[0] == '4' || message.Command[0] == '5' || isNon45Error(message.Command))
-	channel := message.Params[min(1, len(message.Params)-1)]
-	waiter, ok := ic.sendWaiters[channel]
-	if !ok {
-		if !isError && len(message.Params) > 1 {
-			channel = message.Params[0]
-			waiter, ok = ic.sendWaiters[channel]
-		}
-		if !ok {
+	if message.Command == "FAIL" {
+		reply := parseStandardReply(&message)
+		if reply == nil {
 			return false
 		}
+		context := make([]string, len(reply.Context))
+		for i, param := range reply.Context {
+			context[i] = ic.isupport.CaseMapping(param)
+		}
+		return ic.sendWaiters.ResolveStandardReply(reply.Command, context, &message)
 	}
-	if message.Command == waiter.cmd {
-		if message.Nick() != ic.Conn.CurrentNick() {
+	if message.Command == ircevent.RPL_INVITING && len(message.Params) >= 3 {
+		// <client> <nick> <channel>
+		return ic.sendWaiters.Resolve(ic.isupport.CaseMapping(message.Params[1]), message.Command, message.Params[2], &message)
+	}
+	isError := message.Params[0] == ic.Conn.CurrentNick() &&
+		len(message.Command) == 3 &&
+		(message.Command[0] == '4' || message.Command[0] == '5' || isNon45Error(message.Command))
+	if isError {
+		target := message.Params[min(1, len(message.Params)-1)]
+		if (slices.Contains(joinErrorNumerics, message.Command) || message.Command == ircevent.ERR_LINKCHANNEL) &&
+			ic.hasJoinWaiter(target) {
+			// Let the join error handlers pass the error to the JoinChannel call rather than a message to the same channel
 			return false
 		}
-	} else if !isError {
+		return ic.sendWaiters.ResolveError(ic.isupport.CaseMapping(target), &message)
+	} else if message.Nick() != ic.Conn.CurrentNick() {
 		return false
 	}
-	delete(ic.sendWaiters, channel)
-	waiter.ch <- &message
-	return true
+	body := getEchoBody(message.Params)
+	if ic.sendWaiters.Resolve(ic.isupport.CaseMapping(message.Params[0]), message.Command, body, &message) {
+		return true
+	}
+	return len(message.Params) > 1 &&
+		ic.sendWaiters.Resolve(ic.isupport.CaseMapping(message.Params[1]), message.Command, body, &message)
 }
 
 func isNon45Error(cmd string) bool {
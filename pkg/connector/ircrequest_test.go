@@ -0,0 +1,461 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+const fakeNick = "tester"
+
+// fakeServer is a minimal IRC server on the other end of a net.Pipe that handles registration
+// and passes every other line to the handler.
+type fakeServer struct {
+	conn       net.Conn
+	handler    func(fs *fakeServer, msg ircmsg.Message)
+	registered bool
+}
+
+func (fs *fakeServer) send(line string) {
+	_, _ = fmt.Fprintf(fs.conn, "%s\r\n", line)
+}
+
+func (fs *fakeServer) echo(msg ircmsg.Message) {
+	msg.Source = fakeNick + "!user@host"
+	line, _ := msg.Line()
+	_, _ = fs.conn.Write([]byte(line))
+}
+
+func (fs *fakeServer) run() {
+	scanner := bufio.NewScanner(fs.conn)
+	for scanner.Scan() {
+		msg, err := ircmsg.ParseLine(scanner.Text())
+		if err != nil {
+			continue
+		}
+		switch msg.Command {
+		case "CAP":
+			switch msg.Params[0] {
+			case "LS":
+				fs.send(":srv CAP * LS :echo-message")
+			case "REQ":
+				fs.send(":srv CAP * ACK :" + msg.Params[1])
+			}
+		case "NICK":
+			if fs.registered {
+				fs.handler(fs, msg)
+			}
+		case "PING", "PONG":
+		case "USER":
+			fs.registered = true
+			fs.send(":srv 001 " + fakeNick + " :Welcome")
+			fs.send(":srv 422 " + fakeNick + " :MOTD File is missing")
+		case "QUIT":
+			_ = fs.conn.Close()
+			return
+		default:
+			fs.handler(fs, msg)
+		}
+	}
+}
+
+func newFakeClient(t *testing.T, handler func(fs *fakeServer, msg ircmsg.Message)) *IRCClient {
+	t.Helper()
+	ic := &IRCClient{
+		isupport:    defaultISupport,
+		sendWaiters: newSendWaiterQueue(),
+		joinWaiters: make(map[string][]chan *joinResult),
+		Main:        &IRCConnector{},
+	}
+	ic.Conn = &ircevent.Connection{
+		Server:      "fake:6667",
+		Nick:        fakeNick,
+		RequestCaps: []string{"echo-message"},
+		Log:         log.New(io.Discard, "", 0),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go (&fakeServer{conn: server, handler: handler}).run()
+			return client, nil
+		},
+	}
+	ic.Conn.AddDisconnectCallback(ic.onDisconnect)
+	ic.Conn.AddGlobalCallback(ic.onSASLReauth)
+	ic.Conn.AddGlobalCallback(ic.onFallbackReply)
+	ic.Conn.AddGlobalCallback(ic.onRawReply)
+	ic.Conn.AddCallback("PRIVMSG", func(msg ircmsg.Message) {
+		ic.onPotentialEchoMessage(msg)
+	})
+	ic.Conn.AddCallback(ircevent.RPL_ENDOFNAMES, func(msg ircmsg.Message) {
+		ic.resolveJoinSuccess(msg.Params[1], map[string]int{fakeNick: 50})
+	})
+	for _, numeric := range joinErrorNumerics {
+		ic.Conn.AddCallback(numeric, ic.onJoinError)
+	}
+	err := ic.Conn.Connect()
+	if err != nil {
+		t.Fatalf("Failed to connect to fake server: %v", err)
+	}
+	t.Cleanup(func() {
+		ic.Conn.Quit()
+		ic.Conn.DangerousInternalWaitForStop()
+	})
+	return ic
+}
+
+func TestSendRequest_ConcurrentSameTarget(t *testing.T) {
+	const count = 5
+	var pending []ircmsg.Message
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		pending = append(pending, msg)
+		if len(pending) == count {
+			// Echo in reverse order to make sure responses are matched by body rather than order
+			for i := len(pending) - 1; i >= 0; i-- {
+				fs.echo(pending[i])
+			}
+		}
+	})
+	var wg sync.WaitGroup
+	for i := range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := fmt.Sprintf("message %d", i)
+			resp, err := ic.SendRequest(context.Background(), nil, "", "PRIVMSG", "#chan", body)
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+			} else if resp.Params[1] != body {
+				t.Errorf("Request %d got wrong echo %q", i, resp.Params[1])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSendRequest_Error(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		fs.send(":srv 404 " + fakeNick + " " + msg.Params[0] + " :Cannot send to channel")
+	})
+	_, err := ic.SendRequest(context.Background(), nil, "", "PRIVMSG", "#Chan", "hello")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Fatalf("Expected IRCError, got %v", err)
+	} else if ircErr.Msg.Command != "404" {
+		t.Fatalf("Expected 404 error, got %s", ircErr.Msg.Command)
+	}
+}
+
+func TestSendRequest_Invite(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Params[0] == "alice" {
+			fs.send(":srv 341 " + fakeNick + " alice " + msg.Params[1])
+		} else {
+			fs.send(":srv 482 " + fakeNick + " " + msg.Params[1] + " :You're not a channel operator")
+		}
+	})
+	resp, err := ic.SendRequest(context.Background(), nil, "", "INVITE", "alice", "#chan")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if resp.Command != "341" {
+		t.Fatalf("Expected RPL_INVITING, got %s", resp.Command)
+	}
+	// The error is about the channel rather than the invited nick
+	_, err = ic.SendRequest(context.Background(), nil, "", "INVITE", "bob", "#chan")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Fatalf("Expected IRCError, got %v", err)
+	} else if ircErr.Msg.Command != "482" {
+		t.Fatalf("Expected 482 error, got %s", ircErr.Msg.Command)
+	}
+}
+
+func TestSendRequest_Nick(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command != "NICK" {
+			return
+		} else if msg.Params[0] == "taken" {
+			fs.send(":srv 433 " + fakeNick + " taken :Nickname is already in use")
+		} else {
+			fs.echo(msg)
+		}
+	})
+	resp, err := ic.SendRequest(context.Background(), nil, "", "NICK", "newnick")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if resp.Command != "NICK" || resp.Params[0] != "newnick" {
+		t.Fatalf("Expected NICK echo, got %s %v", resp.Command, resp.Params)
+	}
+	_, err = ic.SendRequest(context.Background(), nil, "", "NICK", "taken")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Fatalf("Expected IRCError, got %v", err)
+	} else if ircErr.Msg.Command != ircevent.ERR_NICKNAMEINUSE {
+		t.Fatalf("Expected nick in use error, got %s", ircErr.Msg.Command)
+	}
+}
+
+func TestSendRequest_StandardReply(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command == "REDACT" {
+			fs.send(":srv FAIL REDACT REDACT_FORBIDDEN " + msg.Params[0] + " " + msg.Params[1] + " :You may not redact that")
+		}
+	})
+	// Make sure the reply is matched by target rather than just command
+	go func() {
+		_, _ = ic.SendRequest(context.Background(), nil, "", "REDACT", "#other", "abc")
+	}()
+	_, err := ic.SendRequest(context.Background(), nil, "", "REDACT", "#chan", "msgid")
+	var replyErr *StandardReplyError
+	if !errors.As(err, &replyErr) {
+		t.Fatalf("Expected StandardReplyError, got %v", err)
+	} else if replyErr.Code != "REDACT_FORBIDDEN" || replyErr.Context[0] != "#chan" {
+		t.Fatalf("Got unexpected standard reply %+v", replyErr)
+	}
+	status := bridgev2.WrapErrorInStatus(err)
+	if status.ErrorReason != event.MessageStatusNoPermission {
+		t.Fatalf("Expected no permission status, got %s", status.ErrorReason)
+	}
+}
+
+func TestSendRequest_Cancel(t *testing.T) {
+	var held []ircmsg.Message
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		held = append(held, msg)
+		if msg.Params[1] == "second" {
+			// The echo for the cancelled request arrives first and doesn't match the body
+			// of the second one, it must not be given to the second request.
+			first := held[0]
+			first.Params[1] = "first, but modified by the server"
+			fs.echo(first)
+			fs.echo(msg)
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := ic.SendRequest(ctx, nil, "", "PRIVMSG", "#chan", "first")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %v", err)
+	}
+	resp, err := ic.SendRequest(context.Background(), nil, "", "PRIVMSG", "#chan", "second")
+	if err != nil {
+		t.Fatalf("Second request failed: %v", err)
+	} else if resp.Params[1] != "second" {
+		t.Fatalf("Second request got wrong echo %q", resp.Params[1])
+	}
+}
+
+func TestSendRequest_Disconnect(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		_ = fs.conn.Close()
+	})
+	_, err := ic.SendRequest(context.Background(), nil, "", "PRIVMSG", "#chan", "hello")
+	if err == nil {
+		t.Fatal("Expected error after disconnect")
+	}
+}
+
+func TestSendWaiterQueue_FIFO(t *testing.T) {
+	swq := newSendWaiterQueue()
+	first := swq.Add("#chan", "PRIVMSG", "PRIVMSG", "a")
+	second := swq.Add("#chan", "PRIVMSG", "PRIVMSG", "a")
+	other := swq.Add("#chan", "TAGMSG", "TAGMSG", "")
+	if !swq.Resolve("#chan", "PRIVMSG", "modified", &ircmsg.Message{Command: "PRIVMSG"}) {
+		t.Fatal("Expected unmatched body to resolve oldest waiter")
+	}
+	select {
+	case <-first.ch:
+	default:
+		t.Fatal("First waiter didn't receive response")
+	}
+	if !swq.ResolveError("#chan", &ircmsg.Message{Command: "404"}) {
+		t.Fatal("Expected error to resolve a waiter")
+	}
+	select {
+	case resp := <-second.ch:
+		if resp.Command != "404" {
+			t.Fatalf("Second waiter got unexpected response %s", resp.Command)
+		}
+	default:
+		t.Fatal("Error wasn't given to the oldest remaining waiter")
+	}
+	swq.CloseAll()
+	if _, ok := <-other.ch; ok {
+		t.Fatal("Expected channel to be closed")
+	}
+	if swq.Resolve("#chan", "TAGMSG", "", &ircmsg.Message{}) {
+		t.Fatal("Expected queue to be empty after CloseAll")
+	}
+}
+
+func TestSendWaiterQueue_StandardReplyContext(t *testing.T) {
+	swq := newSendWaiterQueue()
+	first := swq.Add("#a", "PRIVMSG", "PRIVMSG", "x")
+	swq.Add("#b", "PRIVMSG", "PRIVMSG", "y")
+	if swq.ResolveStandardReply("PRIVMSG", []string{"#c"}, &ircmsg.Message{Command: "FAIL"}) {
+		t.Fatal("Expected reply with unknown context not to resolve any of several waiters")
+	}
+	if !swq.ResolveStandardReply("PRIVMSG", []string{"#a"}, &ircmsg.Message{Command: "FAIL"}) {
+		t.Fatal("Expected reply with matching context to resolve a waiter")
+	}
+	select {
+	case <-first.ch:
+	default:
+		t.Fatal("Reply wasn't given to the waiter in the context")
+	}
+	if !swq.ResolveStandardReply("PRIVMSG", nil, &ircmsg.Message{Command: "FAIL"}) {
+		t.Fatal("Expected reply without context to resolve the only remaining waiter")
+	}
+}
+
+func TestJoinChannel(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command != "JOIN" {
+			return
+		}
+		if msg.Params[0] == "#banned" {
+			fs.send(":srv 474 " + fakeNick + " #Banned :Cannot join channel (+b)")
+			return
+		}
+		fs.echo(msg)
+		fs.send(":srv 353 " + fakeNick + " = " + msg.Params[0] + " :@" + fakeNick)
+		fs.send(":srv 366 " + fakeNick + " " + msg.Params[0] + " :End of /NAMES list")
+	})
+	res, err := ic.JoinChannel(context.Background(), "#chan")
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	} else if _, ok := res.Members[fakeNick]; !ok {
+		t.Fatalf("Expected own nick in members, got %v", res.Members)
+	}
+	_, err = ic.JoinChannel(context.Background(), "#banned")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Fatalf("Expected IRCError, got %v", err)
+	} else if ircErr.Msg.Command != ircevent.ERR_BANNEDFROMCHAN {
+		t.Fatalf("Expected banned error, got %s", ircErr.Msg.Command)
+	}
+	ic.chatInfoCache = map[string]*ChatInfoCache{"#chan": {Members: map[string]int{fakeNick: 50}}}
+	_, err = ic.JoinChannel(context.Background(), "#CHAN")
+	if !errors.Is(err, ErrAlreadyInChannel) {
+		t.Fatalf("Expected ErrAlreadyInChannel, got %v", err)
+	}
+}
+
+func TestJoinChannel_ErrorNotTakenBySendWaiter(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command == "JOIN" {
+			fs.send(":srv 474 " + fakeNick + " #banned :Cannot join channel (+b)")
+		}
+	})
+	waiter := ic.sendWaiters.Add("#banned", "PRIVMSG", "PRIVMSG", "hello")
+	_, err := ic.JoinChannel(context.Background(), "#banned")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) || ircErr.Msg.Command != ircevent.ERR_BANNEDFROMCHAN {
+		t.Fatalf("Expected banned error, got %v", err)
+	}
+	select {
+	case res := <-waiter.ch:
+		t.Fatalf("Expected send waiter to stay pending, got %+v", res)
+	default:
+	}
+}
+
+func TestSendRawRequest_SkipsBackgroundReplies(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command != "TIME" {
+			return
+		}
+		// Replies to an ISON poll and a MONITOR notification arrive before the actual reply
+		fs.send(":srv 303 " + fakeNick + " :alice")
+		fs.send(":srv 731 " + fakeNick + " :bob")
+		fs.send(":srv 391 " + fakeNick + " srv :Sunday October 18 2026")
+	})
+	ic.isonPending = [][]string{{"alice"}}
+	resp, err := ic.SendRawRequest(context.Background(), nil, "TIME")
+	if err != nil {
+		t.Fatalf("Raw request failed: %v", err)
+	} else if len(resp) != 1 || resp[0].Command != ircevent.RPL_TIME {
+		t.Fatalf("Expected only the RPL_TIME reply, got %v", resp)
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command != "AUTHENTICATE" {
+			return
+		} else if msg.Params[0] == "PLAIN" {
+			fs.send("AUTHENTICATE +")
+		} else if payload, _ := base64.StdEncoding.DecodeString(msg.Params[0]); strings.HasSuffix(string(payload), "\x00hunter2") {
+			fs.send(":srv 903 " + fakeNick + " :SASL authentication successful")
+		} else {
+			fs.send(":srv 904 " + fakeNick + " :SASL authentication failed")
+		}
+	})
+	err := ic.reauthenticate(context.Background(), "user", "wrong")
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Fatalf("Expected IRCError, got %v", err)
+	} else if ircErr.Msg.Command != ircevent.ERR_SASLFAIL {
+		t.Fatalf("Expected SASL failure, got %s", ircErr.Msg.Command)
+	} else if !ic.Conn.Connected() {
+		t.Fatal("Connection was closed after failed reauthentication")
+	}
+	err = ic.reauthenticate(context.Background(), "user", "hunter2")
+	if err != nil {
+		t.Fatalf("Reauthentication failed: %v", err)
+	}
+}
+
+func TestSendModeChanges_Batches(t *testing.T) {
+	received := make(chan []string, 10)
+	ic := newFakeClient(t, func(fs *fakeServer, msg ircmsg.Message) {
+		if msg.Command == "MODE" {
+			received <- msg.Params
+			fs.echo(msg)
+		}
+	})
+	ic.isupport = ParseISupport(map[string]string{"MODES": "2"})
+	changes := ic.isupport.parseModeChanges("+ooon", []string{"a", "b", "c"})
+	err := ic.sendModeChanges(context.Background(), "#chan", changes)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	close(received)
+	var commands [][]string
+	for params := range received {
+		commands = append(commands, params)
+	}
+	expected := [][]string{{"#chan", "+oo", "a", "b"}, {"#chan", "+on", "c"}}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Fatalf("Expected %v, got %v", expected, commands)
+	}
+}
@@ -18,13 +18,51 @@ package connector
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+
+	"golang.org/x/text/secure/precis"
 )
 
 type ISupport struct {
 	ChanTypes   string
 	CaseMapping StringReplacer
-	PLPrefixes  map[byte]int
+	// CaseMappingName is the value of the CASEMAPPING token, or rfc1459 if the server didn't send one.
+	CaseMappingName string
+	PLPrefixes      map[byte]int
+	// PLModes maps prefix mode letters (e.g. o for op) to power levels.
+	PLModes map[byte]int
+	// PrefixModes maps prefix mode letters to the prefix symbols used in NAMES replies.
+	PrefixModes map[byte]byte
+
+	Network    string
+	NickLen    int
+	ChannelLen int
+	TopicLen   int
+	KickLen    int
+	// ChanModes contains the four groups of channel modes from CHANMODES:
+	// list modes, modes that always take a parameter, modes that take a parameter only when set,
+	// and modes that never take a parameter.
+	ChanModes [4]string
+	// Modes is the maximum number of mode changes with parameters in a single MODE command.
+	Modes     int
+	StatusMsg string
+	// TargMax contains the maximum number of targets for each command. Zero means no limit.
+	TargMax map[string]int
+	LineLen int
+	// Monitor is the maximum number of MONITOR targets. Zero means MONITOR isn't supported
+	// and -1 means there's no limit.
+	Monitor int
+	// Bot is the user mode letter used for marking bots.
+	Bot      string
+	UTF8Only bool
+	// WHOX is true if the server supports requesting specific fields in WHO queries.
+	WHOX bool
+	// EList contains the letters of the extended LIST conditions the server supports,
+	// e.g. M for mask matching and U for user counts.
+	EList string
+	// ClientTagDeny contains the client-only tags that the server doesn't relay.
+	ClientTagDeny []string
 }
 
 var defaultISupport *ISupport
@@ -46,9 +84,28 @@ func modeLetterToPowerLevel(letter byte) int {
 	}
 }
 
+// parseISupportInt parses a numeric ISUPPORT token. If the token has no value, noValue is returned,
+// and if the token is missing or invalid, missing is returned.
+func parseISupportInt(raw map[string]string, key string, noValue, missing int) int {
+	val, ok := raw[key]
+	if !ok {
+		return missing
+	} else if val == "" {
+		return noValue
+	}
+	num, err := strconv.Atoi(val)
+	if err != nil || num < 0 {
+		return missing
+	}
+	return num
+}
+
 func ParseISupport(raw map[string]string) *ISupport {
 	isupport := &ISupport{
-		PLPrefixes: make(map[byte]int),
+		PLPrefixes:  make(map[byte]int),
+		PLModes:     make(map[byte]int),
+		PrefixModes: make(map[byte]byte),
+		TargMax:     make(map[string]int),
 	}
 	if ct, ok := raw["CHANTYPES"]; ok {
 		isupport.ChanTypes = ct
@@ -57,23 +114,90 @@ func ParseISupport(raw map[string]string) *ISupport {
 	}
 	if cm, ok := raw["CASEMAPPING"]; ok {
 		isupport.CaseMapping = parseCasemap(cm)
+		isupport.CaseMappingName = strings.ToLower(cm)
 	} else {
 		isupport.CaseMapping = casemapRFC1459.Replace
+		isupport.CaseMappingName = "rfc1459"
 	}
+	_, isupport.UTF8Only = raw["UTF8ONLY"]
+	_, isupport.WHOX = raw["WHOX"]
+	isupport.EList = strings.ToUpper(raw["ELIST"])
+	modes, symbols := "ov", "@+"
 	if prefixes, ok := raw["PREFIX"]; ok {
-		var modes, symbols string
-		_, err := fmt.Sscanf(prefixes, "(%s)%s", &modes, &symbols)
+		modes, symbols = "", ""
+		_, err := fmt.Sscanf(strings.Replace(prefixes, ")", " ", 1), "(%s %s", &modes, &symbols)
 		if err != nil || modes == "" || symbols == "" || len(modes) != len(symbols) {
 			modes = "qaohv"
 			symbols = "~&@%+"
 		}
-		for i := 0; i < len(modes); i++ {
-			isupport.PLPrefixes[symbols[i]] = modeLetterToPowerLevel(modes[i])
+	}
+	for i := 0; i < len(modes); i++ {
+		isupport.PLPrefixes[symbols[i]] = modeLetterToPowerLevel(modes[i])
+		isupport.PLModes[modes[i]] = modeLetterToPowerLevel(modes[i])
+		isupport.PrefixModes[modes[i]] = symbols[i]
+	}
+	chanModes := strings.SplitN(raw["CHANMODES"], ",", 4)
+	if len(chanModes) != 4 {
+		chanModes = []string{"beI", "k", "l", "imnpst"}
+	}
+	copy(isupport.ChanModes[:], chanModes)
+	isupport.Network = raw["NETWORK"]
+	isupport.NickLen = parseISupportInt(raw, "NICKLEN", 0, 0)
+	isupport.ChannelLen = parseISupportInt(raw, "CHANNELLEN", 0, 0)
+	isupport.TopicLen = parseISupportInt(raw, "TOPICLEN", 0, 0)
+	isupport.KickLen = parseISupportInt(raw, "KICKLEN", 0, 0)
+	isupport.Modes = parseISupportInt(raw, "MODES", 100, 3)
+	isupport.StatusMsg = raw["STATUSMSG"]
+	if targMax, ok := raw["TARGMAX"]; ok {
+		for part := range strings.SplitSeq(targMax, ",") {
+			cmd, limit, _ := strings.Cut(part, ":")
+			isupport.TargMax[strings.ToUpper(cmd)], _ = strconv.Atoi(limit)
 		}
 	}
+	isupport.LineLen = parseISupportInt(raw, "LINELEN", 512, 512)
+	isupport.Monitor = parseISupportInt(raw, "MONITOR", -1, 0)
+	isupport.Bot = raw["BOT"]
+	if clientTagDeny, ok := raw["CLIENTTAGDENY"]; ok {
+		isupport.ClientTagDeny = strings.Split(clientTagDeny, ",")
+	}
 	return isupport
 }
 
+// ClientTagAllowed checks whether the server relays the given client-only tag (without the + prefix).
+func (is *ISupport) ClientTagAllowed(tag string) bool {
+	allowed := true
+	for _, denied := range is.ClientTagDeny {
+		switch denied {
+		case "*":
+			allowed = false
+		case "-" + tag:
+			return true
+		case tag:
+			return false
+		}
+	}
+	return allowed
+}
+
+// modeTakesParam returns whether the given channel mode takes a parameter when it's added or removed.
+func (is *ISupport) modeTakesParam(mode byte, adding bool) bool {
+	switch {
+	case is.PrefixModes[mode] != 0,
+		strings.IndexByte(is.ChanModes[0], mode) >= 0,
+		strings.IndexByte(is.ChanModes[1], mode) >= 0:
+		return true
+	case strings.IndexByte(is.ChanModes[2], mode) >= 0:
+		return adding
+	default:
+		return false
+	}
+}
+
+// StripStatusMsg removes STATUSMSG prefixes (e.g. @ in @#channel) from a message target.
+func (is *ISupport) StripStatusMsg(target string) string {
+	return strings.TrimLeft(target, is.StatusMsg)
+}
+
 var casemapRFC1459, casemapStrictRFC1459, casemapASCII *strings.Replacer
 var casemapNoop = StringReplacer(func(s string) string {
 	return s
@@ -104,6 +228,8 @@ func parseCasemap(name string) StringReplacer {
 		return casemapStrictRFC1459.Replace
 	case "ascii":
 		return casemapASCII.Replace
+	case "rfc7613", "precis":
+		return casemapPRECIS
 	case "unicode":
 		return strings.ToLower
 	default:
@@ -112,3 +238,35 @@ func parseCasemap(name string) StringReplacer {
 }
 
 type StringReplacer func(string) string
+
+// precisCasefold applies the PRECIS UsernameCaseMapped profile until the result stabilizes,
+// like Ergo does. A single pass isn't guaranteed to be idempotent, so RFC 8264 recommends
+// repeating it up to four times.
+func precisCasefold(name string) (string, error) {
+	folded := name
+	for range 4 {
+		next, err := precis.UsernameCaseMapped.CompareKey(folded)
+		if err != nil {
+			return "", err
+		} else if next == folded {
+			return folded, nil
+		}
+		folded = next
+	}
+	return "", fmt.Errorf("casefolding %q didn't stabilize", name)
+}
+
+// casemapPRECIS implements the rfc7613 casemapping used by Ergo. Leading #s of channel names are kept
+// as-is, because they're not valid at the start of a PRECIS string. Names that aren't valid PRECIS
+// identifiers can't exist on the server, so they're just lowercased.
+func casemapPRECIS(name string) string {
+	prefixLen := len(name) - len(strings.TrimLeft(name, "#"))
+	if prefixLen == len(name) {
+		return name
+	}
+	folded, err := precisCasefold(name[prefixLen:])
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return name[:prefixLen] + folded
+}
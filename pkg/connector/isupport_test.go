@@ -0,0 +1,78 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"testing"
+)
+
+// The test cases are based on Ergo's casefolding tests (irc/strings_test.go)
+func TestCasemapPRECIS_Channels(t *testing.T) {
+	testCases := map[string]string{
+		"#foo":                   "#foo",
+		"#rfc1459[noncompliant]": "#rfc1459[noncompliant]",
+		"#{[]}":                  "#{[]}",
+		"#FOO":                   "#foo",
+		"#bang!":                 "#bang!",
+		"#":                      "#",
+		"##":                     "##",
+		"##Ubuntu":               "##ubuntu",
+		"#ä":                     "#ä",
+		"#Ä":                     "#ä",
+		"#中文频道":                  "#中文频道",
+		"#ÖZGÜR":                 "#özgür",
+	}
+	for channel, expected := range testCases {
+		if folded := casemapPRECIS(channel); folded != expected {
+			t.Errorf("Expected %q to casefold to %q, got %q", channel, expected, folded)
+		}
+	}
+}
+
+func TestCasemapPRECIS_Names(t *testing.T) {
+	testCases := map[string]string{
+		"foo":       "foo",
+		"FOO":       "foo",
+		"Shivaram":  "shivaram",
+		"slingamN":  "slingamn",
+		"ＦＯＯ":       "foo",
+		"ΣΑΣ":       "σασ",
+		"ÖzgürKurt": "özgürkurt",
+		"Straße":    "straße",
+	}
+	for name, expected := range testCases {
+		if folded := casemapPRECIS(name); folded != expected {
+			t.Errorf("Expected %q to casefold to %q, got %q", name, expected, folded)
+		}
+	}
+}
+
+func TestCasemapPRECIS_Idempotent(t *testing.T) {
+	for _, name := range []string{"#Ä", "ＦＯＯ", "ΣΑΣ", "İstanbul", "foo bar", "\xff"} {
+		once := casemapPRECIS(name)
+		if twice := casemapPRECIS(once); once != twice {
+			t.Errorf("Casefolding %q isn't idempotent: %q != %q", name, once, twice)
+		}
+	}
+}
+
+func TestParseCasemap(t *testing.T) {
+	casemap := ParseISupport(map[string]string{"CASEMAPPING": "rfc7613"}).CaseMapping
+	if casemap("#Matrix") != casemap("#matrix") {
+		t.Error("Expected rfc7613 casemapping to be case-insensitive")
+	}
+}
@@ -0,0 +1,120 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+const joinTimeout = 30 * time.Second
+
+var (
+	ErrJoinTimeout      = errors.New("timeout waiting for the server to confirm the join")
+	ErrAlreadyInChannel = errors.New("already in the channel")
+)
+
+// joinResult is the outcome of a JOIN sent with JoinChannel.
+type joinResult struct {
+	// Members contains the members of the channel from the NAMES reply sent after joining.
+	Members map[string]int
+	Err     error
+}
+
+// JoinChannel joins a channel and waits until the server has sent the member list, or an error
+// numeric for the channel. If the user is already in the channel, ErrAlreadyInChannel is returned
+// immediately, as the server doesn't reply to the JOIN at all in that case.
+//
+// The JOIN is sent without a label, so that the JOIN, topic and NAMES replies go through the normal
+// handlers, which create and sync the portal.
+func (ic *IRCClient) JoinChannel(ctx context.Context, channel string) (*joinResult, error) {
+	if ic.isInChannel(channel) {
+		return nil, ErrAlreadyInChannel
+	}
+	key := ic.isupport.CaseMapping(channel)
+	ch := make(chan *joinResult, 1)
+	ic.joinWaitersLock.Lock()
+	ic.joinWaiters[key] = append(ic.joinWaiters[key], ch)
+	ic.joinWaitersLock.Unlock()
+	defer ic.removeJoinWaiter(key, ch)
+	err := ic.Conn.Join(channel)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(joinTimeout):
+		return nil, ErrJoinTimeout
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res, nil
+	}
+}
+
+func (ic *IRCClient) removeJoinWaiter(key string, ch chan *joinResult) {
+	ic.joinWaitersLock.Lock()
+	defer ic.joinWaitersLock.Unlock()
+	waiters := slices.DeleteFunc(ic.joinWaiters[key], func(waiter chan *joinResult) bool {
+		return waiter == ch
+	})
+	if len(waiters) == 0 {
+		delete(ic.joinWaiters, key)
+	} else {
+		ic.joinWaiters[key] = waiters
+	}
+}
+
+// hasJoinWaiter returns true if a JoinChannel call is waiting for the given channel.
+func (ic *IRCClient) hasJoinWaiter(channel string) bool {
+	ic.joinWaitersLock.Lock()
+	defer ic.joinWaitersLock.Unlock()
+	_, ok := ic.joinWaiters[ic.isupport.CaseMapping(channel)]
+	return ok
+}
+
+// resolveJoinWaiters passes the result to all JoinChannel calls waiting for the given channel.
+// It returns false if nobody was waiting.
+func (ic *IRCClient) resolveJoinWaiters(channel string, res *joinResult) bool {
+	key := ic.isupport.CaseMapping(channel)
+	ic.joinWaitersLock.Lock()
+	defer ic.joinWaitersLock.Unlock()
+	waiters, ok := ic.joinWaiters[key]
+	if !ok {
+		return false
+	}
+	delete(ic.joinWaiters, key)
+	for _, waiter := range waiters {
+		waiter <- res
+	}
+	return true
+}
+
+func (ic *IRCClient) resolveJoinSuccess(channel string, members map[string]int) {
+	ic.resolveJoinWaiters(channel, &joinResult{Members: maps.Clone(members)})
+}
+
+func (ic *IRCClient) resolveJoinError(channel string, msg ircmsg.Message) bool {
+	return ic.resolveJoinWaiters(channel, &joinResult{Err: &IRCError{Msg: &msg}})
+}
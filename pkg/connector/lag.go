@@ -0,0 +1,102 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+// keepAlivePrefix is the prefix irc-go uses for the tokens of its keepalive pings.
+// The rest of the token is the time the ping was sent in unix nanoseconds.
+const keepAlivePrefix = "KeepAlive-"
+
+// lagReportThreshold is how much the lag has to change before a new bridge state is sent with it.
+const lagReportThreshold = 250 * time.Millisecond
+
+var _ status.BridgeStateFiller = (*IRCClient)(nil)
+
+// configurePing sets the keepalive interval and timeout of the connection based on the ping config.
+//
+// irc-go checks for the pong once per timeout and pings every keepalive interval,
+// so the interval can't be shorter than the timeout.
+func (pc *PingConfig) configurePing(conn *ircevent.Connection) {
+	if pc.Interval <= 0 {
+		return
+	}
+	conn.Timeout = time.Duration(pc.MaxLag) * time.Second
+	if conn.Timeout <= 0 {
+		conn.Timeout = 1 * time.Minute
+	}
+	conn.KeepAlive = max(time.Duration(pc.Interval)*time.Second, conn.Timeout)
+}
+
+func (ic *IRCClient) resetLag() {
+	ic.lagLock.Lock()
+	ic.lag, ic.reportedLag = 0, 0
+	ic.lagLock.Unlock()
+}
+
+func (ic *IRCClient) onPong(msg ircmsg.Message) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	token := msg.Params[len(msg.Params)-1]
+	sentAtStr, ok := strings.CutPrefix(token, keepAlivePrefix)
+	if !ok {
+		return
+	}
+	sentAt, err := strconv.ParseInt(sentAtStr, 10, 64)
+	if err != nil {
+		return
+	}
+	lag := time.Since(time.Unix(0, sentAt))
+	ic.lagLock.Lock()
+	ic.lag = lag
+	// The lag is only included in bridge states, so send a new one when it changes noticeably
+	shouldReport := ic.reportedLag == 0 || (lag-ic.reportedLag).Abs() >= lagReportThreshold
+	if shouldReport {
+		ic.reportedLag = lag
+	}
+	ic.lagLock.Unlock()
+	if shouldReport {
+		ic.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+	}
+}
+
+// GetLag returns the round-trip time of the last answered keepalive ping.
+func (ic *IRCClient) GetLag() time.Duration {
+	ic.lagLock.Lock()
+	defer ic.lagLock.Unlock()
+	return ic.lag
+}
+
+func (ic *IRCClient) FillBridgeState(state status.BridgeState) status.BridgeState {
+	// The lag is zero until the first keepalive ping has been answered
+	if lag := ic.GetLag(); state.StateEvent == status.StateConnected && lag > 0 {
+		if state.Info == nil {
+			state.Info = make(map[string]any)
+		}
+		state.Info["lag_ms"] = lag.Milliseconds()
+	}
+	return state
+}
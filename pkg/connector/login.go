@@ -23,7 +23,9 @@ import (
 	"slices"
 	"strings"
 
+	"github.com/ergochat/irc-go/ircevent"
 	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridgev2"
@@ -35,6 +37,10 @@ var loginFlows = []bridgev2.LoginFlow{{
 	Name:        "Nick",
 	Description: "Connect to an IRC network with the address, nick and optionally password",
 	ID:          "nick",
+}, {
+	Name:        "Register",
+	Description: "Register a new account on an IRC network that supports account registration",
+	ID:          "register",
 }}
 
 func (ic *IRCConnector) GetLoginFlows() []bridgev2.LoginFlow {
@@ -42,15 +48,31 @@ func (ic *IRCConnector) GetLoginFlows() []bridgev2.LoginFlow {
 }
 
 func (ic *IRCConnector) CreateLogin(ctx context.Context, user *bridgev2.User, flowID string) (bridgev2.LoginProcess, error) {
-	if flowID != loginFlows[0].ID {
+	if !slices.ContainsFunc(loginFlows, func(flow bridgev2.LoginFlow) bool { return flow.ID == flowID }) {
 		return nil, fmt.Errorf("unknown flow ID: %s", flowID)
 	}
-	return &IRCLogin{User: user, Main: ic}, nil
+	return &IRCLogin{User: user, Main: ic, FlowID: flowID}, nil
 }
 
 type IRCLogin struct {
-	User *bridgev2.User
-	Main *IRCConnector
+	User   *bridgev2.User
+	Main   *IRCConnector
+	FlowID string
+
+	login *bridgev2.UserLogin
+	// prevState is the state of an existing login that is being replaced,
+	// which is restored if the new connection doesn't work out.
+	prevState *loginSnapshot
+	// pendingAccount and pendingPassword are set when an account registration is waiting for verification.
+	pendingAccount  string
+	pendingPassword string
+}
+
+// loginSnapshot contains the fields of a login that are changed when logging in again.
+type loginSnapshot struct {
+	Metadata      UserLoginMetadata
+	RemoteName    string
+	RemoteProfile status.RemoteProfile
 }
 
 var _ bridgev2.LoginProcessUserInput = (*IRCLogin)(nil)
@@ -61,17 +83,28 @@ func (zl *IRCLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 	if err != nil {
 		return nil, err
 	}
+	if zl.FlowID == "register" {
+		return zl.makeRegisterStep(""), nil
+	}
+	return zl.makeCredentialsStep(""), nil
+}
+
+func (zl *IRCLogin) makeNetworkField() bridgev2.LoginInputDataField {
+	return bridgev2.LoginInputDataField{
+		Type:    bridgev2.LoginInputFieldTypeSelect,
+		ID:      "network",
+		Name:    "IRC network",
+		Options: slices.Collect(maps.Keys(zl.Main.Config.Networks)),
+	}
+}
+
+func (zl *IRCLogin) makeCredentialsStep(instructions string) *bridgev2.LoginStep {
 	return &bridgev2.LoginStep{
 		Type:         bridgev2.LoginStepTypeUserInput,
 		StepID:       "fi.mau.irc.credentials",
-		Instructions: "",
+		Instructions: instructions,
 		UserInputParams: &bridgev2.LoginUserInputParams{
-			Fields: []bridgev2.LoginInputDataField{{
-				Type:    bridgev2.LoginInputFieldTypeSelect,
-				ID:      "network",
-				Name:    "IRC network",
-				Options: slices.Collect(maps.Keys(zl.Main.Config.Networks)),
-			}, {
+			Fields: []bridgev2.LoginInputDataField{zl.makeNetworkField(), {
 				Type: bridgev2.LoginInputFieldTypeUsername,
 				ID:   "nick",
 				Name: "IRC nick",
@@ -83,20 +116,203 @@ func (zl *IRCLogin) Start(ctx context.Context) (*bridgev2.LoginStep, error) {
 				Pattern:     "^.*:.*$",
 			}},
 		},
-	}, nil
+	}
 }
 
-func (zl *IRCLogin) Cancel() {}
+func (zl *IRCLogin) makeRegisterStep(instructions string) *bridgev2.LoginStep {
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       "fi.mau.irc.register",
+		Instructions: instructions,
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{zl.makeNetworkField(), {
+				Type:        bridgev2.LoginInputFieldTypeUsername,
+				ID:          "nick",
+				Name:        "IRC nick",
+				Description: "The nick to register, which will also be the account name",
+			}, {
+				Type:        bridgev2.LoginInputFieldTypeEmail,
+				ID:          "email",
+				Name:        "Email",
+				Description: "The network may send a verification code to this address",
+			}, {
+				Type: bridgev2.LoginInputFieldTypePassword,
+				ID:   "password",
+				Name: "Account password",
+			}},
+		},
+	}
+}
+
+func (zl *IRCLogin) makeVerifyStep(instructions string) *bridgev2.LoginStep {
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeUserInput,
+		StepID:       "fi.mau.irc.verify",
+		Instructions: instructions,
+		UserInputParams: &bridgev2.LoginUserInputParams{
+			Fields: []bridgev2.LoginInputDataField{{
+				Type: bridgev2.LoginInputFieldType2FACode,
+				ID:   "code",
+				Name: "Verification code",
+			}},
+		},
+	}
+}
+
+func (zl *IRCLogin) makeCompleteStep(instructions string) *bridgev2.LoginStep {
+	login := zl.login
+	zl.login = nil
+	return &bridgev2.LoginStep{
+		Type:         bridgev2.LoginStepTypeComplete,
+		StepID:       "fi.mau.irc.complete",
+		Instructions: instructions,
+		CompleteParams: &bridgev2.LoginCompleteParams{
+			UserLoginID: login.ID,
+			UserLogin:   login,
+		},
+	}
+}
+
+func (zl *IRCLogin) Cancel() {
+	if zl.login != nil {
+		zl.discardLogin(zl.Main.Bridge.BackgroundCtx)
+	}
+}
 
 var (
 	ErrUnknownNetwork = bridgev2.WrapRespErr(errors.New("unknown network"), mautrix.MNotFound)
+	ErrNickInUse      = errors.New("nick is already in use")
 )
 
+func humanizeLoginError(err error) string {
+	switch {
+	case errors.Is(err, ircevent.SASLError):
+		return fmt.Sprintf("authentication failed (%s)", err)
+	case errors.Is(err, ErrConnectTimeout):
+		return "timed out waiting for the server"
+	default:
+		return humanizeError(err)
+	}
+}
+
+// connectLogin creates the login and waits for it to connect to the network. If the connection fails,
+// the login is discarded and the error is returned.
+//
+// If the user is already logged into the network, the existing login is reconnected with the new nick and
+// credentials instead. Other settings like autojoin channels are kept, and the previous state is restored
+// if the connection fails. Nothing is saved until the login process is complete.
+func (zl *IRCLogin) connectLogin(ctx context.Context, netMeta *NetworkConfig, meta *UserLoginMetadata) error {
+	loginID := makeUserLoginID(meta.Server, zl.User.MXID)
+	if existing := zl.Main.Bridge.GetCachedUserLoginByID(loginID); existing != nil && existing.UserMXID == zl.User.MXID {
+		return zl.reconnectExistingLogin(ctx, existing, netMeta, meta)
+	}
+	login, err := zl.User.NewLogin(ctx, &database.UserLogin{
+		ID:         loginID,
+		RemoteName: fmt.Sprintf("%s on %s", meta.Nick, netMeta.DisplayName),
+		RemoteProfile: status.RemoteProfile{
+			Name: meta.Nick,
+		},
+		Metadata: meta,
+	}, &bridgev2.NewLoginParams{})
+	if err != nil {
+		return err
+	}
+	zl.login = login
+	cli := login.Client.(*IRCClient)
+	cli.validatingLogin.Store(true)
+	cli.Connect(login.Log.WithContext(zl.Main.Bridge.BackgroundCtx))
+	return zl.waitForLoginConnect(ctx, cli, meta.Nick)
+}
+
+func (zl *IRCLogin) reconnectExistingLogin(ctx context.Context, existing *bridgev2.UserLogin, netMeta *NetworkConfig, meta *UserLoginMetadata) error {
+	prevMeta := existing.Metadata.(*UserLoginMetadata)
+	zl.prevState = &loginSnapshot{
+		Metadata:      *prevMeta,
+		RemoteName:    existing.RemoteName,
+		RemoteProfile: existing.RemoteProfile,
+	}
+	zl.prevState.Metadata.Channels = slices.Clone(prevMeta.Channels)
+	meta.RealName = prevMeta.RealName
+	meta.Channels = slices.Clone(prevMeta.Channels)
+	meta.AwayMessage, meta.DisableAutoAway = prevMeta.AwayMessage, prevMeta.DisableAutoAway
+	meta.CommandPassthrough = prevMeta.CommandPassthrough
+	zl.login = existing
+	// Stop the previous connection, as it would otherwise conflict with the new one
+	existing.Client.(*IRCClient).Disconnect()
+	existing.Metadata = meta
+	existing.RemoteName = fmt.Sprintf("%s on %s", meta.Nick, netMeta.DisplayName)
+	existing.RemoteProfile.Name = meta.Nick
+	err := zl.Main.LoadUserLogin(ctx, existing)
+	if err != nil {
+		zl.discardLogin(ctx)
+		return fmt.Errorf("failed to recreate client: %w", err)
+	}
+	cli := existing.Client.(*IRCClient)
+	cli.validatingLogin.Store(true)
+	cli.Connect(existing.Log.WithContext(zl.Main.Bridge.BackgroundCtx))
+	return zl.waitForLoginConnect(ctx, cli, meta.Nick)
+}
+
+// waitForLoginConnect waits for the client created by the login process to connect with the expected nick.
+func (zl *IRCLogin) waitForLoginConnect(ctx context.Context, cli *IRCClient, nick string) error {
+	err := cli.waitForConnect(ctx)
+	if err == nil && cli.isupport.CaseMapping(cli.Conn.CurrentNick()) != cli.isupport.CaseMapping(nick) {
+		err = fmt.Errorf("%w: %s", ErrNickInUse, nick)
+	}
+	cli.validatingLogin.Store(false)
+	if err != nil {
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Connection failed during login")
+		zl.discardLogin(ctx)
+		return err
+	}
+	return nil
+}
+
+// saveLogin saves the login after the login process has succeeded. New logins are already in the database,
+// but changes to existing logins are only saved once the new connection is known to work.
+func (zl *IRCLogin) saveLogin(ctx context.Context) error {
+	err := zl.login.Save(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	zl.prevState = nil
+	return nil
+}
+
+// discardLogin deletes the login created by this login process, so that a broken login isn't left behind.
+// If an existing login was being replaced, its previous state is restored and it's reconnected instead.
+func (zl *IRCLogin) discardLogin(ctx context.Context) {
+	zl.login.Client.(*IRCClient).Disconnect()
+	if zl.prevState == nil {
+		zl.login.Delete(ctx, status.BridgeState{StateEvent: status.StateLoggedOut}, bridgev2.DeleteOpts{
+			DontCleanupRooms: true,
+		})
+	} else {
+		zl.login.Metadata = &zl.prevState.Metadata
+		zl.login.RemoteName = zl.prevState.RemoteName
+		zl.login.RemoteProfile = zl.prevState.RemoteProfile
+		err := zl.Main.LoadUserLogin(ctx, zl.login)
+		if err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to recreate client with previous login state")
+		} else {
+			zl.login.Client.Connect(zl.login.Log.WithContext(zl.Main.Bridge.BackgroundCtx))
+		}
+	}
+	zl.login = nil
+	zl.prevState = nil
+	zl.pendingAccount, zl.pendingPassword = "", ""
+}
+
 func (zl *IRCLogin) SubmitUserInput(ctx context.Context, input map[string]string) (*bridgev2.LoginStep, error) {
+	if zl.pendingAccount != "" {
+		return zl.submitVerificationCode(ctx, input["code"])
+	}
 	netName := strings.ToLower(input["network"])
 	netMeta, ok := zl.Main.Config.Networks[netName]
 	if !ok {
 		return nil, ErrUnknownNetwork.AppendMessage(" %s", netName)
+	} else if zl.FlowID == "register" {
+		return zl.submitRegistration(ctx, netMeta, input)
 	}
 	creds := strings.SplitN(strings.TrimSpace(input["credentials"]), ":", 2)
 	var authUser, authPass string
@@ -112,25 +328,67 @@ func (zl *IRCLogin) SubmitUserInput(ctx context.Context, input map[string]string
 		SASLUser: authUser,
 		Channels: nil,
 	}
-	login, err := zl.User.NewLogin(ctx, &database.UserLogin{
-		ID:         makeUserLoginID(netName, zl.User.MXID),
-		RemoteName: fmt.Sprintf("%s on %s", meta.Nick, netMeta.DisplayName),
-		RemoteProfile: status.RemoteProfile{
-			Name: meta.Nick,
-		},
-		Metadata: meta,
-	}, &bridgev2.NewLoginParams{})
+	err := zl.connectLogin(ctx, netMeta, meta)
+	if err != nil {
+		return zl.makeCredentialsStep(fmt.Sprintf("Failed to connect to %s: %s. Please try again.", netMeta.DisplayName, humanizeLoginError(err))), nil
+	}
+	err = zl.saveLogin(ctx)
 	if err != nil {
+		zl.discardLogin(ctx)
 		return nil, err
 	}
-	go login.Client.Connect(login.Log.WithContext(zl.Main.Bridge.BackgroundCtx))
-	return &bridgev2.LoginStep{
-		Type:         bridgev2.LoginStepTypeComplete,
-		StepID:       "fi.mau.irc.complete",
-		Instructions: fmt.Sprintf("Connecting to %s as %s", netMeta.DisplayName, meta.Nick),
-		CompleteParams: &bridgev2.LoginCompleteParams{
-			UserLoginID: login.ID,
-			UserLogin:   login,
-		},
-	}, nil
+	return zl.makeCompleteStep(fmt.Sprintf("Connected to %s as %s", netMeta.DisplayName, meta.Nick)), nil
+}
+
+// submitRegistration connects to the network without authentication and registers an account for the nick.
+func (zl *IRCLogin) submitRegistration(ctx context.Context, netMeta *NetworkConfig, input map[string]string) (*bridgev2.LoginStep, error) {
+	meta := &UserLoginMetadata{
+		Server:   netMeta.Name,
+		Nick:     input["nick"],
+		RealName: zl.User.MXID.String(),
+	}
+	err := zl.connectLogin(ctx, netMeta, meta)
+	if err != nil {
+		return zl.makeRegisterStep(fmt.Sprintf("Failed to connect to %s: %s. Please try again.", netMeta.DisplayName, humanizeLoginError(err))), nil
+	}
+	resp, err := zl.login.Client.(*IRCClient).RegisterAccount(ctx, input["email"], input["password"])
+	if errors.Is(err, ErrAccountRegistrationUnsupported) {
+		// Trying again won't help, the user has to log in with an existing account instead
+		zl.discardLogin(ctx)
+		return nil, bridgev2.WrapRespErr(fmt.Errorf("%s doesn't support account registration", netMeta.DisplayName), mautrix.MUnrecognized)
+	} else if err != nil {
+		zl.discardLogin(ctx)
+		return zl.makeRegisterStep(fmt.Sprintf("Failed to register account on %s: %s. Please try again.", netMeta.DisplayName, humanizeLoginError(err))), nil
+	} else if resp.Status == "VERIFICATION_REQUIRED" {
+		zl.pendingAccount, zl.pendingPassword = resp.Account, input["password"]
+		return zl.makeVerifyStep(resp.Message), nil
+	}
+	return zl.finishRegistration(ctx, resp.Account, input["password"])
+}
+
+func (zl *IRCLogin) submitVerificationCode(ctx context.Context, code string) (*bridgev2.LoginStep, error) {
+	resp, err := zl.login.Client.(*IRCClient).VerifyAccount(ctx, zl.pendingAccount, strings.TrimSpace(code))
+	var sre *StandardReplyError
+	if errors.As(err, &sre) && sre.Code == "INVALID_CODE" {
+		return zl.makeVerifyStep(fmt.Sprintf("%s. Please try again.", sre.HumanMessage())), nil
+	} else if err != nil {
+		zl.discardLogin(ctx)
+		return nil, fmt.Errorf("failed to verify account: %w", err)
+	}
+	return zl.finishRegistration(ctx, resp.Account, zl.pendingPassword)
+}
+
+// finishRegistration stores the credentials of the newly registered account, so that they're used for SASL
+// on future connections. The current connection is already logged in after a successful registration.
+func (zl *IRCLogin) finishRegistration(ctx context.Context, account, password string) (*bridgev2.LoginStep, error) {
+	meta := zl.login.Metadata.(*UserLoginMetadata)
+	meta.SASLUser, meta.Password = account, password
+	zl.pendingAccount, zl.pendingPassword = "", ""
+	err := zl.saveLogin(ctx)
+	if err != nil {
+		zl.discardLogin(ctx)
+		return nil, err
+	}
+	netName := zl.login.Client.(*IRCClient).NetMeta.DisplayName
+	return zl.makeCompleteStep(fmt.Sprintf("Registered account %s and connected to %s", account, netName)), nil
 }
@@ -0,0 +1,140 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+type modeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+// parseModeChanges parses a mode string like +ov-b and its parameters into individual changes.
+func (is *ISupport) parseModeChanges(modes string, params []string) []modeChange {
+	var changes []modeChange
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			change := modeChange{Add: adding, Mode: modes[i]}
+			if is.modeTakesParam(modes[i], adding) && len(params) > 0 {
+				change.Param = params[0]
+				params = params[1:]
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// formatModeChanges formats mode changes into a mode string and parameters for a MODE command.
+func formatModeChanges(changes []modeChange) (string, []string) {
+	var modes strings.Builder
+	var params []string
+	var lastAdd *bool
+	for _, change := range changes {
+		if lastAdd == nil || *lastAdd != change.Add {
+			if change.Add {
+				modes.WriteByte('+')
+			} else {
+				modes.WriteByte('-')
+			}
+			lastAdd = &change.Add
+		}
+		modes.WriteByte(change.Mode)
+		if change.Param != "" {
+			params = append(params, change.Param)
+		}
+	}
+	return modes.String(), params
+}
+
+// sendModeChanges sends mode changes to the channel, splitting them into multiple MODE commands
+// so that each command has at most as many parameterized changes as the server allows.
+func (ic *IRCClient) sendModeChanges(ctx context.Context, channel string, changes []modeChange) error {
+	batchSize := max(ic.isupport.Modes, 1)
+	for len(changes) > 0 {
+		var batch []modeChange
+		paramCount := 0
+		for len(changes) > 0 {
+			if changes[0].Param != "" {
+				if paramCount == batchSize {
+					break
+				}
+				paramCount++
+			}
+			batch = append(batch, changes[0])
+			changes = changes[1:]
+		}
+		modes, params := formatModeChanges(batch)
+		_, err := ic.SendRequest(ctx, nil, "", "MODE", append([]string{channel, modes}, params...)...)
+		if err != nil {
+			return err
+		}
+		ic.chatInfoCacheLock.Lock()
+		ic.unlockedApplyModeChanges(channel, batch)
+		ic.chatInfoCacheLock.Unlock()
+	}
+	return nil
+}
+
+// unlockedApplyModeChanges updates the cached power levels of channel members.
+func (ic *IRCClient) unlockedApplyModeChanges(channel string, changes []modeChange) {
+	info, ok := ic.chatInfoCache[channel]
+	if !ok {
+		return
+	}
+	for _, change := range changes {
+		modePL, isPrefix := ic.isupport.PLModes[change.Mode]
+		if !isPrefix || change.Param == "" {
+			continue
+		}
+		nick := change.Param
+		currentPL, isMember := info.Members[nick]
+		if !isMember {
+			continue
+		}
+		if change.Add {
+			info.Members[nick] = max(currentPL, modePL)
+		} else if currentPL == modePL {
+			// The user may still have lower prefix modes, but there's no way to know without
+			// multi-prefix NAMES, so assume they don't have any until the next resync.
+			info.Members[nick] = 0
+		}
+	}
+}
+
+func (ic *IRCClient) onMode(msg ircmsg.Message) {
+	if len(msg.Params) < 2 || ic.isDM(msg.Params[0]) {
+		return
+	}
+	channel := msg.Params[0]
+	changes := ic.isupport.parseModeChanges(msg.Params[1], msg.Params[2:])
+	ic.chatInfoCacheLock.Lock()
+	ic.unlockedApplyModeChanges(channel, changes)
+	ic.chatInfoCacheLock.Unlock()
+}
@@ -0,0 +1,281 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	// isonInterval is how often nicks that can't be monitored are polled with ISON.
+	isonInterval = 60 * time.Second
+	// monitorBatchSize is the maximum length of the target list in a single MONITOR or ISON command.
+	monitorBatchSize = 400
+)
+
+func makeOfflineError(nick string) error {
+	return bridgev2.WrapErrorInStatus(fmt.Errorf("%s is offline", nick)).
+		WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusGenericError)
+}
+
+// batchTargets splits nicks into groups whose joined length fits in a single command.
+// If maxCount is positive, the groups also have at most that many targets.
+func batchTargets(nicks []string, sep string, maxCount int) [][]string {
+	var batches [][]string
+	var batch []string
+	batchLen := 0
+	for _, nick := range nicks {
+		if len(batch) > 0 && (batchLen+len(sep)+len(nick) > monitorBatchSize || len(batch) == maxCount) {
+			batches = append(batches, batch)
+			batch, batchLen = nil, 0
+		}
+		if len(batch) > 0 {
+			batchLen += len(sep)
+		}
+		batch = append(batch, nick)
+		batchLen += len(nick)
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// startMonitoring starts tracking the online status of everyone the user has a DM portal with.
+func (ic *IRCClient) startMonitoring() {
+	ic.stopMonitoring()
+	log := ic.UserLogin.Log.With().Str("action", "start monitoring").Logger()
+	ctx := log.WithContext(ic.Main.Bridge.BackgroundCtx)
+	portalIDs, err := ic.getDMPortalIDs(ctx)
+	if err != nil {
+		log.Err(err).Msg("Failed to get DM portals")
+		return
+	}
+	nicks := make([]string, 0, len(portalIDs))
+	for _, portalID := range portalIDs {
+		nick, err := ic.parsePortalID(portalID)
+		if err != nil || !ic.isDM(nick) {
+			continue
+		}
+		nicks = append(nicks, ic.casemappedNames.GetDefault(nick, nick))
+	}
+	log.Debug().Int("target_count", len(nicks)).Msg("Monitoring DM targets")
+	ic.addMonitorTargets(nicks...)
+}
+
+// stopMonitoring clears all online status tracking, which is needed when the connection is lost,
+// as the server forgets the MONITOR list.
+func (ic *IRCClient) stopMonitoring() {
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	if ic.isonStop != nil {
+		close(ic.isonStop)
+		ic.isonStop = nil
+	}
+	clear(ic.monitorTargets)
+	clear(ic.isonTargets)
+	clear(ic.onlineNicks)
+	ic.isonPending = nil
+}
+
+// addMonitorTargets starts tracking the online status of the given nicks. MONITOR is used
+// as long as the server supports it and the limit isn't reached, after that ISON polling is used.
+func (ic *IRCClient) addMonitorTargets(nicks ...string) {
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	var newMonitorTargets []string
+	for _, nick := range nicks {
+		mappedNick := ic.isupport.CaseMapping(nick)
+		if _, ok := ic.monitorTargets[mappedNick]; ok {
+			continue
+		} else if _, ok = ic.isonTargets[mappedNick]; ok {
+			continue
+		}
+		monitorLimit := ic.isupport.Monitor
+		if monitorLimit == -1 || len(ic.monitorTargets) < monitorLimit {
+			ic.monitorTargets[mappedNick] = nick
+			newMonitorTargets = append(newMonitorTargets, nick)
+		} else {
+			ic.isonTargets[mappedNick] = nick
+		}
+	}
+	for _, batch := range batchTargets(newMonitorTargets, ",", 0) {
+		err := ic.Conn.Send("MONITOR", "+", strings.Join(batch, ","))
+		if err != nil {
+			ic.UserLogin.Log.Err(err).Msg("Failed to send MONITOR command")
+		}
+	}
+	ic.unlockedEnsureISONLoop()
+}
+
+func (ic *IRCClient) unlockedEnsureISONLoop() {
+	if len(ic.isonTargets) > 0 && ic.isonStop == nil {
+		ic.isonStop = make(chan struct{})
+		go ic.isonLoop(ic.isonStop)
+	}
+}
+
+func (ic *IRCClient) isonLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(isonInterval)
+	defer ticker.Stop()
+	for {
+		ic.sendISON()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ic *IRCClient) sendISON() {
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	if len(ic.isonPending) > 0 {
+		// The previous poll hasn't been answered yet
+		return
+	}
+	targets := slices.Sorted(maps.Values(ic.isonTargets))
+	for _, batch := range batchTargets(targets, " ", 0) {
+		err := ic.Conn.Send("ISON", batch...)
+		if err != nil {
+			ic.UserLogin.Log.Err(err).Msg("Failed to send ISON command")
+			return
+		}
+		ic.isonPending = append(ic.isonPending, batch)
+	}
+}
+
+// isISONPending returns true if an ISON poll is waiting for a reply.
+func (ic *IRCClient) isISONPending() bool {
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	return len(ic.isonPending) > 0
+}
+
+// isMonitored returns true if the online status of the nick is tracked with MONITOR or ISON.
+func (ic *IRCClient) isMonitored(nick string) bool {
+	mappedNick := ic.isupport.CaseMapping(nick)
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	_, isMonitored := ic.monitorTargets[mappedNick]
+	_, isPolled := ic.isonTargets[mappedNick]
+	return isMonitored || isPolled
+}
+
+// isKnownOffline returns true if the nick is tracked with MONITOR and the server said it's offline.
+// ISON results may be up to a minute old, so nicks that are only polled are never considered offline:
+// messages to them are sent anyway and the server will reply with ERR_NOSUCHNICK if they're gone.
+func (ic *IRCClient) isKnownOffline(nick string) bool {
+	mappedNick := ic.isupport.CaseMapping(nick)
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	if _, isMonitored := ic.monitorTargets[mappedNick]; !isMonitored {
+		return false
+	}
+	online, known := ic.onlineNicks[mappedNick]
+	return known && !online
+}
+
+// setOnline stores the online status of a tracked nick and updates the ghost's presence if it changed.
+func (ic *IRCClient) setOnline(nick string, online bool) {
+	mappedNick := ic.isupport.CaseMapping(nick)
+	ic.monitorLock.Lock()
+	_, isMonitored := ic.monitorTargets[mappedNick]
+	_, isPolled := ic.isonTargets[mappedNick]
+	prevOnline, known := ic.onlineNicks[mappedNick]
+	changed := (isMonitored || isPolled) && (!known || prevOnline != online)
+	if changed {
+		ic.onlineNicks[mappedNick] = online
+	}
+	ic.monitorLock.Unlock()
+	if !changed {
+		return
+	} else if online {
+		ic.updateGhostPresence(nick)
+	} else {
+		ic.setGhostPresence(ic.makeUserID(nick), event.PresenceOffline, "")
+	}
+}
+
+func (ic *IRCClient) onMonitorOnline(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	for target := range strings.SplitSeq(msg.Params[1], ",") {
+		nuh, err := ircmsg.ParseNUH(target)
+		if err == nil {
+			ic.setOnline(nuh.Name, true)
+		}
+	}
+}
+
+func (ic *IRCClient) onMonitorOffline(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	for nick := range strings.SplitSeq(msg.Params[1], ",") {
+		ic.setOnline(nick, false)
+	}
+}
+
+func (ic *IRCClient) onMonitorListFull(msg ircmsg.Message) {
+	// <client> <limit> <targets> :Monitor list is full
+	if len(msg.Params) < 3 {
+		return
+	}
+	ic.monitorLock.Lock()
+	defer ic.monitorLock.Unlock()
+	for nick := range strings.SplitSeq(msg.Params[2], ",") {
+		mappedNick := ic.isupport.CaseMapping(nick)
+		if _, ok := ic.monitorTargets[mappedNick]; ok {
+			delete(ic.monitorTargets, mappedNick)
+			ic.isonTargets[mappedNick] = nick
+		}
+	}
+	ic.unlockedEnsureISONLoop()
+}
+
+func (ic *IRCClient) onISON(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	ic.monitorLock.Lock()
+	if len(ic.isonPending) == 0 {
+		ic.monitorLock.Unlock()
+		return
+	}
+	batch := ic.isonPending[0]
+	ic.isonPending = ic.isonPending[1:]
+	ic.monitorLock.Unlock()
+	onlineNicks := make(map[string]struct{})
+	for nick := range strings.FieldsSeq(msg.Params[1]) {
+		onlineNicks[ic.isupport.CaseMapping(nick)] = struct{}{}
+	}
+	for _, nick := range batch {
+		_, online := onlineNicks[ic.isupport.CaseMapping(nick)]
+		ic.setOnline(nick, online)
+	}
+}
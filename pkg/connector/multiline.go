@@ -0,0 +1,174 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+)
+
+type multilineLimits struct {
+	MaxBytes int
+	MaxLines int
+}
+
+// getMultilineLimits returns the limits advertised in the draft/multiline cap,
+// or nil if multiline batches can't be sent on this connection.
+func (ic *IRCClient) getMultilineLimits() *multilineLimits {
+	caps := ic.Conn.AcknowledgedCaps()
+	value, ok := caps["draft/multiline"]
+	// Labeled responses are needed to find out whether the batch was accepted
+	_, hasLabels := caps["labeled-response"]
+	if !ok || !hasLabels {
+		return nil
+	}
+	var limits multilineLimits
+	for part := range strings.SplitSeq(value, ",") {
+		key, val, _ := strings.Cut(part, "=")
+		num, _ := strconv.Atoi(val)
+		switch key {
+		case "max-bytes":
+			limits.MaxBytes = num
+		case "max-lines":
+			limits.MaxLines = num
+		}
+	}
+	if limits.MaxBytes <= 0 {
+		// max-bytes is mandatory, so the cap value is broken
+		return nil
+	}
+	return &limits
+}
+
+// splitLine splits a line into chunks of at most maxLength bytes without breaking UTF-8 sequences.
+func splitLine(line string, maxLength int) []string {
+	if len(line) <= maxLength {
+		return []string{line}
+	}
+	var chunks []string
+	for len(line) > maxLength {
+		chunk := ircmsg.TruncateUTF8Safe(line, maxLength)
+		if chunk == "" {
+			chunk = line[:maxLength]
+		}
+		chunks = append(chunks, chunk)
+		line = line[len(chunk):]
+	}
+	if line != "" {
+		chunks = append(chunks, line)
+	}
+	return chunks
+}
+
+// sendText sends a PRIVMSG or NOTICE that may contain multiple lines or be longer than a single IRC line.
+// If the server supports draft/multiline, the text is sent as a batch. Otherwise, each line is sent
+// as a separate message and the response to the first one is returned.
+func (ic *IRCClient) sendText(ctx context.Context, tags map[string]string, cmd, channel, text string) (*ircmsg.Message, error) {
+	maxLength := ic.maxMessageLength(ic.Conn.CurrentNick(), cmd, channel)
+	if !strings.ContainsRune(text, '\n') && len(text) <= maxLength {
+		return ic.SendRequest(ctx, tags, "", cmd, channel, text)
+	}
+	lines := strings.Split(text, "\n")
+	if limits := ic.getMultilineLimits(); limits != nil {
+		if len(text) > limits.MaxBytes {
+			return nil, makeTooLongError("message", len(text), limits.MaxBytes)
+		} else if limits.MaxLines > 0 && len(lines) > limits.MaxLines {
+			return nil, bridgev2.WrapErrorInStatus(fmt.Errorf("message has too many lines (%d/%d)", len(lines), limits.MaxLines)).
+				WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusGenericError)
+		}
+		return ic.sendMultilineBatch(ctx, tags, cmd, channel, lines, maxLength)
+	}
+	for _, line := range lines {
+		if len(line) > maxLength {
+			return nil, makeTooLongError("line", len(line), maxLength)
+		}
+	}
+	var firstResp *ircmsg.Message
+	for _, line := range lines {
+		if line == "" {
+			// Empty messages aren't allowed outside multiline batches
+			continue
+		}
+		resp, err := ic.SendRequest(ctx, tags, "", cmd, channel, line)
+		if err != nil {
+			return nil, err
+		}
+		if firstResp == nil {
+			firstResp = resp
+			// Reply tags etc. only apply to the first line
+			tags = nil
+		}
+	}
+	if firstResp == nil {
+		return nil, fmt.Errorf("message is empty")
+	}
+	return firstResp, nil
+}
+
+func (ic *IRCClient) sendMultilineBatch(ctx context.Context, tags map[string]string, cmd, channel string, lines []string, maxLength int) (*ircmsg.Message, error) {
+	ref := random.String(16)
+	respCh := make(chan *ircevent.Batch, 1)
+	err := ic.Conn.SendWithLabel(func(batch *ircevent.Batch) {
+		respCh <- batch
+	}, tags, "BATCH", "+"+ref, "draft/multiline", channel)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		for i, chunk := range splitLine(line, maxLength) {
+			lineTags := map[string]string{"batch": ref}
+			if i > 0 {
+				lineTags["draft/multiline-concat"] = ""
+			}
+			err = ic.Conn.SendIRCMessage(ircmsg.MakeMessage(lineTags, "", cmd, channel, chunk))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err = ic.Conn.Send("BATCH", "-"+ref)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp := <-respCh:
+		switch {
+		case resp == nil:
+			return nil, ircevent.NoLabeledResponse
+		case resp.Command == "BATCH" && len(resp.Params) > 1 && resp.Params[1] == "draft/multiline" && len(resp.Items) > 0:
+			return multilineBatchToMessage(resp), nil
+		case resp.Command == "ACK":
+			// The server accepted the batch, but didn't echo it
+			msg := ircmsg.MakeMessage(nil, "", cmd, channel, strings.Join(lines, "\n"))
+			return &msg, nil
+		case resp.Command == "FAIL":
+			return nil, makeStandardReplyError(&resp.Message)
+		default:
+			return nil, &IRCError{Msg: &resp.Message}
+		}
+	}
+}
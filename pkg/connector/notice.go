@@ -0,0 +1,67 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// getNoticeRoom returns the portal room of the given channel if it exists, or the management room otherwise.
+func (ic *IRCClient) getNoticeRoom(ctx context.Context, channel string) (id.RoomID, error) {
+	if channel != "" {
+		portal, err := ic.Main.Bridge.GetExistingPortalByKey(ctx, ic.makePortalKey(channel))
+		if err != nil {
+			return "", fmt.Errorf("failed to get portal: %w", err)
+		} else if portal != nil && portal.MXID != "" {
+			return portal.MXID, nil
+		}
+	}
+	mgmtRoom, err := ic.UserLogin.User.GetManagementRoom(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get management room: %w", err)
+	}
+	return mgmtRoom, nil
+}
+
+// sendNotice sends a markdown notice from the bridge bot to the portal of the given channel,
+// or to the management room if the channel is empty or doesn't have a portal.
+func (ic *IRCClient) sendNotice(ctx context.Context, channel, text string, ts time.Time) {
+	log := ic.UserLogin.Log.With().Str("action", "send notice").Str("channel", channel).Logger()
+	roomID, err := ic.getNoticeRoom(ctx, channel)
+	if err != nil {
+		log.Err(err).Msg("Failed to find room for notice")
+		return
+	}
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = event.MsgNotice
+	content.Mentions = &event.Mentions{}
+	_, err = ic.Main.Bridge.Bot.SendMessage(ctx, roomID, event.EventMessage, &event.Content{
+		Parsed: &content,
+	}, &bridgev2.MatrixSendExtra{
+		Timestamp: ts,
+	})
+	if err != nil {
+		log.Err(err).Stringer("room_id", roomID).Msg("Failed to send notice")
+	}
+}
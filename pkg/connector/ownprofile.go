@@ -0,0 +1,102 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2/status"
+)
+
+var ErrInvalidRealName = errors.New("invalid real name")
+
+// updateRemoteProfile sets the remote name and profile of the login based on the current nick.
+func (ic *IRCClient) updateRemoteProfile() {
+	ic.UserLogin.RemoteName = fmt.Sprintf("%s on %s", ic.Conn.CurrentNick(), ic.NetMeta.DisplayName)
+	ic.UserLogin.RemoteProfile.Name = ic.Conn.CurrentNick()
+}
+
+// SetNick changes the nick of the user. If the bridge is connected, the nick is only saved after
+// the server has accepted it. Otherwise, it's saved and used the next time the bridge connects.
+func (ic *IRCClient) SetNick(ctx context.Context, nick string) error {
+	if err := ic.validateNick(nick); err != nil {
+		return err
+	}
+	if !ic.Conn.Connected() {
+		meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+		meta.Nick = nick
+		err := ic.UserLogin.Save(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to save login: %w", err)
+		}
+		// Conn.SetNick would also send a NICK command, so only change the nick used for the next connection
+		ic.Conn.Nick = nick
+		return nil
+	}
+	resp, err := ic.SendRequest(ctx, nil, "", "NICK", nick)
+	if err != nil {
+		return err
+	}
+	// The echo was consumed by the send waiter, so pass it to the normal handlers to update
+	// the current and preferred nick of the connection and save the new nick in onOwnNickChange.
+	ic.Conn.HandleMessage(*resp)
+	return nil
+}
+
+// onOwnNickChange persists nick changes confirmed by the server, including ones made using raw commands,
+// and updates the remote profile of the login to match.
+func (ic *IRCClient) onOwnNickChange(newNick string) {
+	meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+	meta.Nick = newNick
+	ic.updateRemoteProfile()
+	ctx := ic.UserLogin.Log.With().Str("action", "save own nick change").Logger().WithContext(ic.Main.Bridge.BackgroundCtx)
+	err := ic.UserLogin.Save(ctx)
+	if err != nil {
+		ic.UserLogin.Log.Err(err).Msg("Failed to save login after nick change")
+	}
+	ic.UserLogin.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnected})
+}
+
+// SetRealName changes the real name of the user. The change is applied immediately with SETNAME
+// if the server supports it, in which case it's only saved after the server has accepted it.
+// Otherwise, it's saved and used the next time the bridge connects.
+func (ic *IRCClient) SetRealName(ctx context.Context, realName string) (appliedNow bool, err error) {
+	if realName == "" || strings.ContainsAny(realName, "\x00\r\n") {
+		return false, fmt.Errorf("%w: %q", ErrInvalidRealName, realName)
+	}
+	if _, hasSetname := ic.Conn.AcknowledgedCaps()["setname"]; hasSetname && ic.Conn.Connected() {
+		var resp *ircmsg.Message
+		resp, err = ic.SendRequest(ctx, nil, "", "SETNAME", realName)
+		if err != nil {
+			return false, err
+		}
+		ic.Conn.HandleMessage(*resp)
+		appliedNow = true
+	}
+	meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+	meta.RealName = realName
+	ic.Conn.RealName = realName
+	err = ic.UserLogin.Save(ctx)
+	if err != nil {
+		return appliedNow, fmt.Errorf("failed to save login: %w", err)
+	}
+	return appliedNow, nil
+}
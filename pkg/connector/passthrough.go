@@ -0,0 +1,200 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+var ErrEmptyCommand = errors.New("empty command")
+
+func isChannelName(name string, is *ISupport) bool {
+	return name != "" && strings.IndexByte(is.ChanTypes, name[0]) >= 0
+}
+
+// parseClientCommand converts a command typed like in a traditional IRC client (e.g. `mode +o nick` or
+// `msg NickServ help`) into an IRC command. Commands that apply to a channel use the given target
+// as the default channel.
+func parseClientCommand(line, target, ownNick string, is *ISupport) (cmd string, args []string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, ErrEmptyCommand
+	}
+	cmd = strings.ToUpper(fields[0])
+	rest := strings.TrimSpace(strings.TrimSpace(line)[len(fields[0]):])
+	fields = fields[1:]
+	withDefaultChannel := func() []string {
+		if len(fields) > 0 && isChannelName(fields[0], is) {
+			return fields
+		}
+		return append([]string{target}, fields...)
+	}
+	switch cmd {
+	case "MSG", "QUERY", "NOTICE":
+		msgTarget, text, _ := strings.Cut(rest, " ")
+		text = strings.TrimSpace(text)
+		if msgTarget == "" || text == "" {
+			return "", nil, fmt.Errorf("usage: %s <target> <message>", strings.ToLower(cmd))
+		}
+		if cmd != "NOTICE" {
+			cmd = "PRIVMSG"
+		}
+		return cmd, []string{msgTarget, text}, nil
+	case "TOPIC", "PART":
+		channel := target
+		if len(fields) > 0 && isChannelName(fields[0], is) {
+			channel = fields[0]
+			rest = strings.TrimSpace(strings.TrimPrefix(rest, fields[0]))
+		}
+		if rest == "" {
+			return cmd, []string{channel}, nil
+		}
+		return cmd, []string{channel, rest}, nil
+	case "KICK":
+		args = withDefaultChannel()
+		if len(args) < 2 {
+			return "", nil, fmt.Errorf("usage: kick [channel] <nick> [reason]")
+		} else if len(args) > 2 {
+			args = append(args[:2], strings.Join(args[2:], " "))
+			if is.KickLen > 0 && len(args[2]) > is.KickLen {
+				return "", nil, fmt.Errorf("kick reason is too long (%d/%d bytes)", len(args[2]), is.KickLen)
+			}
+		}
+		return cmd, args, nil
+	case "INVITE":
+		if len(fields) == 0 {
+			return "", nil, fmt.Errorf("usage: invite <nick> [channel]")
+		} else if len(fields) == 1 {
+			fields = append(fields, target)
+		}
+		return cmd, fields, nil
+	case "MODE":
+		if len(fields) > 0 && is.CaseMapping(fields[0]) == is.CaseMapping(ownNick) {
+			return cmd, fields, nil
+		}
+		return cmd, withDefaultChannel(), nil
+	case "NAMES":
+		return cmd, withDefaultChannel(), nil
+	case "QUOTE", "RAW":
+		if len(fields) == 0 {
+			return "", nil, ErrEmptyCommand
+		}
+		return strings.ToUpper(fields[0]), splitRawArgs(fields[1:]), nil
+	default:
+		return cmd, splitRawArgs(fields), nil
+	}
+}
+
+// isRequestCommand returns true if the command is answered with an echo of itself or a specific reply
+// when it succeeds, which means it can be sent with SendRequest to find out if it failed.
+func isRequestCommand(cmd string, args []string) bool {
+	switch cmd {
+	case "PRIVMSG", "NOTICE", "PART":
+		return len(args) > 0
+	case "TOPIC", "KICK", "INVITE":
+		return len(args) > 1
+	case "MODE":
+		// Mode queries and list mode queries like MODE #channel +b are answered with numerics instead
+		if len(args) < 2 || (!strings.HasPrefix(args[1], "+") && !strings.HasPrefix(args[1], "-")) {
+			return false
+		}
+		return len(args) > 2 || !strings.ContainsAny(args[1], "beIq")
+	default:
+		return false
+	}
+}
+
+// getPassthroughCommand returns the IRC client command in the message if the user has enabled command passthrough.
+func (ic *IRCClient) getPassthroughCommand(msg *bridgev2.MatrixMessage) (string, bool) {
+	prefix := ic.Main.Config.PassthroughPrefix
+	if prefix == "" || msg.Content.MsgType != event.MsgText || !ic.UserLogin.Metadata.(*UserLoginMetadata).CommandPassthrough {
+		return "", false
+	}
+	return strings.CutPrefix(msg.Content.Body, prefix)
+}
+
+// handlePassthroughCommand sends an IRC client command typed in a portal and shows the result as a notice.
+func (ic *IRCClient) handlePassthroughCommand(ctx context.Context, channel, line string) (*bridgev2.MatrixMessageResponse, error) {
+	cmd, args, err := parseClientCommand(line, ic.casemappedNames.GetDefault(channel, channel), ic.Conn.CurrentNick(), ic.isupport)
+	if err != nil {
+		return nil, bridgev2.WrapErrorInStatus(err).
+			WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusGenericError)
+	}
+	parsed := ircmsg.MakeMessage(nil, "", cmd, args...)
+	rawLine, _ := parsed.Line()
+	rawLine = format.SafeMarkdownCode(strings.TrimSpace(rawLine))
+	if cmd == "JOIN" && len(args) == 1 && !strings.ContainsRune(args[0], ',') {
+		_, err = ic.JoinChannel(ctx, args[0])
+		if err != nil {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Failed to send %s: %s", rawLine, humanizeError(err)), time.Now())
+		}
+	} else if isRequestCommand(cmd, args) {
+		resp, err := ic.SendRequest(ctx, nil, "", cmd, args...)
+		if err != nil {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Failed to send %s: %s", rawLine, humanizeError(err)), time.Now())
+		} else if resp.Source != "" && !ic.dispatchEcho(*resp) {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Sent %s, got response:\n\n%s", rawLine, formatRawResponse([]ircmsg.Message{*resp})), time.Now())
+		}
+	} else {
+		resp, err := ic.SendRawRequest(ctx, nil, cmd, args...)
+		if err != nil {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Failed to send %s: %s", rawLine, humanizeError(err)), time.Now())
+		} else if len(resp) == 0 {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Sent %s, no response received", rawLine), time.Now())
+		} else if slices.ContainsFunc(resp, isErrorReply) {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Failed to send %s:\n\n%s", rawLine, formatRawResponse(resp)), time.Now())
+		} else {
+			ic.sendNotice(ctx, channel, fmt.Sprintf("Sent %s, got response:\n\n%s", rawLine, formatRawResponse(resp)), time.Now())
+		}
+	}
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:        ic.makeLocalMessageID(),
+			SenderID:  ic.makeUserID(ic.Conn.CurrentNick()),
+			Timestamp: time.Now(),
+		},
+	}, nil
+}
+
+// dispatchEcho passes the echo of a request to the normal handlers to bridge the result like it came from IRC,
+// as echoes are consumed by the send waiters. It returns false if the echo isn't bridged.
+func (ic *IRCClient) dispatchEcho(msg ircmsg.Message) bool {
+	switch msg.Command {
+	case "PRIVMSG", "NOTICE":
+		ic.onMessage(msg)
+	case "PART":
+		ic.onJoinPart(msg)
+	case "MODE":
+		ic.onMode(msg)
+	case "TOPIC":
+		ic.onNewTopic(msg)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseClientCommand(t *testing.T) {
+	is := ParseISupport(map[string]string{"CHANTYPES": "#&"})
+	testCases := []struct {
+		line         string
+		expectedCmd  string
+		expectedArgs []string
+	}{
+		{"mode +o alice", "MODE", []string{"#chan", "+o", "alice"}},
+		{"mode #other +m", "MODE", []string{"#other", "+m"}},
+		{"mode Me +i", "MODE", []string{"Me", "+i"}},
+		{"kick alice", "KICK", []string{"#chan", "alice"}},
+		{"kick #other alice stop that", "KICK", []string{"#other", "alice", "stop that"}},
+		{"topic", "TOPIC", []string{"#chan"}},
+		{"topic  new topic here", "TOPIC", []string{"#chan", "new topic here"}},
+		{"part #other bye all", "PART", []string{"#other", "bye all"}},
+		{"invite alice", "INVITE", []string{"alice", "#chan"}},
+		{"msg NickServ  identify foo bar", "PRIVMSG", []string{"NickServ", "identify foo bar"}},
+		{"notice bob hi", "NOTICE", []string{"bob", "hi"}},
+		{"quote PRIVMSG #chan :hello world", "PRIVMSG", []string{"#chan", "hello world"}},
+		{"whois alice", "WHOIS", []string{"alice"}},
+	}
+	for _, tc := range testCases {
+		cmd, args, err := parseClientCommand(tc.line, "#chan", "me", is)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", tc.line, err)
+		} else if cmd != tc.expectedCmd || !slices.Equal(args, tc.expectedArgs) {
+			t.Errorf("Expected %q to parse into %s %q, got %s %q", tc.line, tc.expectedCmd, tc.expectedArgs, cmd, args)
+		}
+	}
+	for _, line := range []string{"", "msg alice", "kick", "quote"} {
+		if _, _, err := parseClientCommand(line, "#chan", "me", is); err == nil {
+			t.Errorf("Expected error parsing %q", line)
+		}
+	}
+	is = ParseISupport(map[string]string{"KICKLEN": "5"})
+	if _, _, err := parseClientCommand("kick alice too long", "#chan", "me", is); err == nil {
+		t.Errorf("Expected error for kick reason over KICKLEN")
+	}
+}
@@ -0,0 +1,188 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+const (
+	// rawRequestTimeout is how long to wait for the first reply to a raw request without labeled-response.
+	rawRequestTimeout = 5 * time.Second
+	// rawRequestIdleTimeout is how long to wait for more replies after the previous one if the reply
+	// doesn't have a known end numeric.
+	rawRequestIdleTimeout = 1 * time.Second
+)
+
+// rawReplyEndNumerics are the numerics that mark the end of a multi-line reply.
+var rawReplyEndNumerics = map[string]struct{}{
+	ircevent.RPL_ENDOFWHOIS: {}, ircevent.RPL_ENDOFWHOWAS: {}, ircevent.RPL_ENDOFWHO: {},
+	ircevent.RPL_LISTEND: {}, ircevent.RPL_ENDOFNAMES: {}, ircevent.RPL_ENDOFMONLIST: {},
+	ircevent.RPL_ENDOFBANLIST: {}, ircevent.RPL_ENDOFEXCEPTLIST: {}, ircevent.RPL_ENDOFINVITELIST: {},
+	ircevent.RPL_ENDOFMOTD: {}, ircevent.ERR_NOMOTD: {}, ircevent.RPL_ENDOFINFO: {},
+	ircevent.RPL_ENDOFLINKS: {}, ircevent.RPL_ENDOFSTATS: {}, ircevent.RPL_ENDOFUSERS: {},
+	ircevent.RPL_ENDOFHELP: {}, ircevent.ERR_HELPNOTFOUND: {},
+	ircevent.RPL_ISON: {}, ircevent.RPL_USERHOST: {}, ircevent.RPL_TIME: {},
+}
+
+func isRawReplyEnd(msg ircmsg.Message) bool {
+	if _, isEnd := rawReplyEndNumerics[msg.Command]; isEnd {
+		return true
+	}
+	return isErrorReply(msg)
+}
+
+// isErrorReply returns true if the message is a FAIL standard reply or an error numeric.
+func isErrorReply(msg ircmsg.Message) bool {
+	return msg.Command == "FAIL" || (len(msg.Command) == 3 && (msg.Command[0] == '4' || msg.Command[0] == '5'))
+}
+
+func flattenBatch(batch *ircevent.Batch, into []ircmsg.Message) []ircmsg.Message {
+	if batch.Command != "BATCH" {
+		if batch.Command != "ACK" {
+			into = append(into, batch.Message)
+		}
+		return into
+	}
+	for _, item := range batch.Items {
+		into = flattenBatch(item, into)
+	}
+	return into
+}
+
+// SendRawRequest sends a command and returns all lines of the reply. If the server supports labeled-response,
+// the reply is the contents of the response batch. Otherwise, all numerics and standard replies are collected
+// until a known end numeric, an error, or until the server stops sending them.
+func (ic *IRCClient) SendRawRequest(ctx context.Context, tags map[string]string, cmd string, args ...string) ([]ircmsg.Message, error) {
+	resp, err := ic.getLabeledResponse(ctx, tags, cmd, args...)
+	if err == nil {
+		return flattenBatch(resp, nil), nil
+	} else if !errors.Is(err, ircevent.CapabilityNotNegotiated) {
+		return nil, err
+	}
+	// Only one request can be collected at a time, as the replies can't be told apart otherwise
+	ic.rawRequestLock.Lock()
+	defer ic.rawRequestLock.Unlock()
+	updated := make(chan struct{}, 1)
+	ic.rawResultsLock.Lock()
+	ic.rawResults, ic.rawResultsEnded, ic.rawResultsUpdated = nil, false, updated
+	ic.rawResultsLock.Unlock()
+	defer func() {
+		ic.rawResultsLock.Lock()
+		ic.rawResults, ic.rawResultsEnded, ic.rawResultsUpdated = nil, false, nil
+		ic.rawResultsLock.Unlock()
+	}()
+	err = ic.Conn.SendIRCMessage(ircmsg.MakeMessage(tags, "", cmd, args...))
+	if err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(rawRequestTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			ic.rawResultsLock.Lock()
+			results := ic.rawResults
+			ic.rawResultsLock.Unlock()
+			return results, nil
+		case <-updated:
+			ic.rawResultsLock.Lock()
+			ended := ic.rawResultsEnded
+			results := ic.rawResults
+			ic.rawResultsLock.Unlock()
+			if ended {
+				return results, nil
+			}
+			timer.Reset(rawRequestIdleTimeout)
+		}
+	}
+}
+
+// wasRawReply returns true if the message currently being handled was collected as a reply to SendRawRequest.
+// This is only valid in callbacks that run after onRawReply for the same message.
+func (ic *IRCClient) wasRawReply() bool {
+	ic.rawResultsLock.Lock()
+	defer ic.rawResultsLock.Unlock()
+	return ic.rawReplyCollected
+}
+
+// isBackgroundReply returns true if the message is a reply to a query that the bridge made in the background,
+// like MONITOR and ISON for online status or WHO and WHOIS for user info, or a notification about one.
+func (ic *IRCClient) isBackgroundReply(msg ircmsg.Message) bool {
+	if len(msg.Params) < 2 {
+		return false
+	}
+	switch msg.Command {
+	case ircevent.RPL_MONONLINE, ircevent.RPL_MONOFFLINE, ircevent.ERR_MONLISTFULL:
+		return true
+	case ircevent.RPL_ISON:
+		return ic.isISONPending()
+	case ircevent.RPL_WHOSPCRPL:
+		return msg.Params[1] == whoxToken || msg.Params[1] == whoSearchToken
+	case ircevent.RPL_WHOREPLY:
+		return len(msg.Params) > 5 && (ic.hasUserQueryWaiter(msg.Params[5]) || ic.isSearchingWHO())
+	case ircevent.RPL_ENDOFWHO:
+		return ic.hasUserQueryWaiter(msg.Params[1]) || ic.isFetchingChannelAccounts(msg.Params[1])
+	case ircevent.RPL_NAMREPLY:
+		return len(msg.Params) > 2 && ic.hasJoinWaiter(msg.Params[2])
+	case ircevent.RPL_ENDOFNAMES, ircevent.RPL_TOPIC, ircevent.RPL_TOPICTIME:
+		return ic.hasJoinWaiter(msg.Params[1])
+	}
+	if _, isWhois := statusWhoisNumerics[msg.Command]; isWhois || msg.Command == ircevent.RPL_ENDOFWHOIS {
+		return ic.hasUserQueryWaiter(msg.Params[1])
+	}
+	return false
+}
+
+// onRawReply is a global callback that collects replies for SendRawRequest.
+// Replies to the bridge's own background queries are skipped, as they can't be told apart otherwise.
+func (ic *IRCClient) onRawReply(msg ircmsg.Message) bool {
+	ic.rawResultsLock.Lock()
+	ic.rawReplyCollected = false
+	collecting := ic.rawResultsUpdated != nil && !ic.rawResultsEnded
+	ic.rawResultsLock.Unlock()
+	if !collecting {
+		return false
+	}
+	isNumeric := len(msg.Command) == 3 && len(msg.Params) > 0 && msg.Params[0] == ic.Conn.CurrentNick()
+	isStandardReply := msg.Command == "FAIL" || msg.Command == "WARN" || msg.Command == "NOTE"
+	if !isNumeric && !isStandardReply && msg.Nick() != ic.Conn.CurrentNick() {
+		return false
+	} else if ic.isBackgroundReply(msg) {
+		return false
+	}
+	ic.rawResultsLock.Lock()
+	defer ic.rawResultsLock.Unlock()
+	if ic.rawResultsUpdated == nil || ic.rawResultsEnded {
+		return false
+	}
+	ic.rawReplyCollected = true
+	ic.rawResults = append(ic.rawResults, msg)
+	ic.rawResultsEnded = isRawReplyEnd(msg)
+	select {
+	case ic.rawResultsUpdated <- struct{}{}:
+	default:
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/ergochat/irc-go/ircutils"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2"
+)
+
+const (
+	saslReauthTimeout = 30 * time.Second
+	connectTimeout    = 30 * time.Second
+)
+
+var (
+	ErrSASLReauthUnsupported = errors.New("server doesn't support reauthentication")
+	ErrSASLReauthInProgress  = errors.New("another reauthentication is already in progress")
+	ErrConnectTimeout        = errors.New("timed out waiting for connection")
+)
+
+// saslReauthState contains the credentials of an ongoing reauthentication and the channel for its result.
+type saslReauthState struct {
+	user     string
+	password string
+	result   chan error
+}
+
+// onSASLReauth is a global callback that handles the SASL exchange when reauthenticating after registration.
+// The IRC library's own handlers are skipped, as they're only meant for the initial authentication
+// and would disconnect if the new credentials are rejected.
+func (ic *IRCClient) onSASLReauth(msg ircmsg.Message) bool {
+	ic.saslReauthLock.Lock()
+	defer ic.saslReauthLock.Unlock()
+	state := ic.saslReauth
+	if state == nil {
+		return false
+	}
+	var err error
+	switch msg.Command {
+	case "AUTHENTICATE":
+		if len(msg.Params) == 0 || msg.Params[0] != "+" {
+			return true
+		}
+		payload := fmt.Sprintf("%s\x00%s\x00%s", state.user, state.user, state.password)
+		for _, resp := range ircutils.EncodeSASLResponse([]byte(payload)) {
+			err = ic.Conn.Send("AUTHENTICATE", resp)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return true
+		}
+	case ircevent.RPL_SASLSUCCESS:
+	case ircevent.RPL_LOGGEDOUT:
+		// Some servers log out the old account before logging into the new one
+		return true
+	case ircevent.ERR_SASLALREADY:
+		err = ErrSASLReauthUnsupported
+	case ircevent.ERR_NICKLOCKED, ircevent.ERR_SASLFAIL, ircevent.ERR_SASLTOOLONG, ircevent.ERR_SASLABORTED:
+		err = &IRCError{Msg: &msg}
+	default:
+		return false
+	}
+	select {
+	case state.result <- err:
+	default:
+	}
+	ic.saslReauth = nil
+	return true
+}
+
+// canReauthenticate checks if the current connection can switch to the given SASL credentials without reconnecting.
+func (ic *IRCClient) canReauthenticate(user string) bool {
+	_, hasSASL := ic.Conn.AcknowledgedCaps()["sasl"]
+	isPlain := ic.Conn.SASLMech == "" || ic.Conn.SASLMech == "PLAIN"
+	return ic.Conn.Connected() && hasSASL && isPlain && user != ""
+}
+
+// reauthenticate authenticates the current connection again with the given credentials.
+// The connection keeps using the previous credentials if the server rejects the new ones.
+func (ic *IRCClient) reauthenticate(ctx context.Context, user, password string) error {
+	state := &saslReauthState{user: user, password: password, result: make(chan error, 1)}
+	ic.saslReauthLock.Lock()
+	if ic.saslReauth != nil {
+		ic.saslReauthLock.Unlock()
+		return ErrSASLReauthInProgress
+	}
+	ic.saslReauth = state
+	ic.saslReauthLock.Unlock()
+	defer func() {
+		ic.saslReauthLock.Lock()
+		if ic.saslReauth == state {
+			ic.saslReauth = nil
+		}
+		ic.saslReauthLock.Unlock()
+	}()
+	err := ic.Conn.Send("AUTHENTICATE", "PLAIN")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, saslReauthTimeout)
+	defer cancel()
+	select {
+	case err = <-state.result:
+		return err
+	case <-ctx.Done():
+		// Abort the exchange so that it doesn't get mixed up with a later one
+		_ = ic.Conn.Send("AUTHENTICATE", "*")
+		return ctx.Err()
+	}
+}
+
+// notifyConnectResult resolves the current waitForConnect call, if any.
+func (ic *IRCClient) notifyConnectResult(err error) {
+	select {
+	case ic.connectResult <- err:
+	default:
+	}
+}
+
+// waitForConnect waits until the connection is registered or fails. Transient errors end the wait too,
+// but the connect loop keeps retrying in the background.
+func (ic *IRCClient) waitForConnect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	select {
+	case err := <-ic.connectResult:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ErrConnectTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+// reconnectLogin replaces the client of the login with a new one using the current login metadata,
+// then waits for it to connect.
+func (ic *IRCConnector) reconnectLogin(ctx context.Context, login *bridgev2.UserLogin) error {
+	login.Client.(*IRCClient).Disconnect()
+	err := ic.LoadUserLogin(ctx, login)
+	if err != nil {
+		return fmt.Errorf("failed to recreate client: %w", err)
+	}
+	cli := login.Client.(*IRCClient)
+	cli.Connect(login.Log.WithContext(ic.Bridge.BackgroundCtx))
+	return cli.waitForConnect(ctx)
+}
+
+// applySASLCredentials switches the login to new SASL credentials, either by reauthenticating on the current
+// connection or by reconnecting if that isn't possible. The credentials are only saved if authentication succeeds,
+// otherwise the previous ones are restored.
+func (ic *IRCConnector) applySASLCredentials(ctx context.Context, login *bridgev2.UserLogin, user, password string) error {
+	cli := login.Client.(*IRCClient)
+	meta := login.Metadata.(*UserLoginMetadata)
+	if cli.Conn == nil {
+		return fmt.Errorf("unknown network")
+	} else if cli.canReauthenticate(user) {
+		err := cli.reauthenticate(ctx, user, password)
+		if err == nil {
+			meta.SASLUser, meta.Password = user, password
+			cli.Conn.SASLLogin, cli.Conn.SASLPassword, cli.Conn.UseSASL = user, password, true
+			return saveLogin(ctx, login)
+		} else if !errors.Is(err, ErrSASLReauthUnsupported) {
+			return err
+		}
+		zerolog.Ctx(ctx).Debug().Msg("Server doesn't support SASL reauthentication, reconnecting instead")
+	}
+	prevUser, prevPassword := meta.SASLUser, meta.Password
+	meta.SASLUser, meta.Password = user, password
+	err := ic.reconnectLogin(ctx, login)
+	if err != nil {
+		meta.SASLUser, meta.Password = prevUser, prevPassword
+		if reconnectErr := ic.reconnectLogin(ctx, login); reconnectErr != nil {
+			zerolog.Ctx(ctx).Err(reconnectErr).Msg("Failed to reconnect with previous SASL credentials")
+		}
+		return err
+	}
+	return saveLogin(ctx, login)
+}
+
+func saveLogin(ctx context.Context, login *bridgev2.UserLogin) error {
+	err := login.Save(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save login: %w", err)
+	}
+	return nil
+}
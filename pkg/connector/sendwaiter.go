@@ -0,0 +1,223 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+// cancelledWaiterTTL is how long a cancelled waiter is kept in the queue so that a late
+// response to it doesn't get matched with a newer request to the same target.
+const cancelledWaiterTTL = 30 * time.Second
+
+type sendWaiter struct {
+	ch      chan *ircmsg.Message
+	key     sendWaiterKey
+	sentCmd string
+	body    string
+	seq     uint64
+	// altTargets are other targets that error numerics for the request may be about,
+	// e.g. the nick in a KICK or the channel in an INVITE.
+	altTargets []string
+
+	cancelledAt time.Time
+}
+
+type sendWaiterKey struct {
+	target string
+	cmd    string
+}
+
+// sendWaiterQueue correlates responses from the server with requests that are waiting for them.
+//
+// Waiters are stored in a FIFO queue per target and command. Responses are matched to the oldest
+// waiter with the same body, or the oldest waiter in the queue if the body doesn't match any of them
+// (e.g. because the server modified the message).
+type sendWaiterQueue struct {
+	lock    sync.Mutex
+	waiters map[sendWaiterKey][]*sendWaiter
+	seq     uint64
+}
+
+func newSendWaiterQueue() *sendWaiterQueue {
+	return &sendWaiterQueue{
+		waiters: make(map[sendWaiterKey][]*sendWaiter),
+	}
+}
+
+// Add adds a new waiter for a request. The sent command is only used for matching standard replies,
+// while the waiter command is the command of the expected response. Alternative targets are only
+// used for matching error numerics.
+func (swq *sendWaiterQueue) Add(target, sentCmd, waiterCmd, body string, altTargets ...string) *sendWaiter {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	swq.seq++
+	key := sendWaiterKey{target: target, cmd: waiterCmd}
+	waiter := &sendWaiter{
+		ch:      make(chan *ircmsg.Message, 1),
+		key:     key,
+		sentCmd: sentCmd,
+		body:    body,
+		seq:     swq.seq,
+
+		altTargets: altTargets,
+	}
+	swq.waiters[key] = append(swq.unlockedPrune(key), waiter)
+	return waiter
+}
+
+// Remove removes the waiter from the queue. Any later responses will be matched to other waiters.
+func (swq *sendWaiterQueue) Remove(waiter *sendWaiter) {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	swq.unlockedRemove(waiter)
+}
+
+// Cancel marks the waiter as cancelled. The waiter is kept in the queue for a while to swallow
+// the response in case the server still sends it.
+func (swq *sendWaiterQueue) Cancel(waiter *sendWaiter) {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	if slices.Contains(swq.waiters[waiter.key], waiter) {
+		waiter.cancelledAt = time.Now()
+	}
+}
+
+// Resolve passes the message to the waiter matching the given target, command and body.
+// It returns true if a waiter was found, even if the waiter had already been cancelled.
+func (swq *sendWaiterQueue) Resolve(target, cmd, body string, msg *ircmsg.Message) bool {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	key := sendWaiterKey{target: target, cmd: cmd}
+	queue := swq.unlockedPrune(key)
+	if len(queue) == 0 {
+		return false
+	}
+	idx := slices.IndexFunc(queue, func(waiter *sendWaiter) bool {
+		return waiter.body == body
+	})
+	if idx == -1 {
+		idx = 0
+	}
+	swq.unlockedDeliver(queue[idx], msg)
+	return true
+}
+
+// ResolveError passes the error message to the oldest waiter for the given target regardless of command.
+// Waiters that have the target as an alternative target are also considered.
+func (swq *sendWaiterQueue) ResolveError(target string, msg *ircmsg.Message) bool {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	var oldest *sendWaiter
+	for key := range swq.waiters {
+		for _, waiter := range swq.unlockedPrune(key) {
+			if key.target != target && !slices.Contains(waiter.altTargets, target) {
+				continue
+			} else if oldest == nil || waiter.seq < oldest.seq {
+				oldest = waiter
+			}
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	swq.unlockedDeliver(oldest, msg)
+	return true
+}
+
+// ResolveStandardReply passes a standard reply to the oldest waiter whose request used the given command
+// and whose target is included in the reply context. If no target matches, the reply is only passed on
+// when there's exactly one waiter for the command, as it could be unrelated to any pending request.
+func (swq *sendWaiterQueue) ResolveStandardReply(sentCmd string, context []string, msg *ircmsg.Message) bool {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	var only, oldestInContext *sendWaiter
+	count := 0
+	for key := range swq.waiters {
+		inContext := slices.Contains(context, key.target)
+		for _, waiter := range swq.unlockedPrune(key) {
+			if waiter.sentCmd != sentCmd {
+				continue
+			}
+			count++
+			only = waiter
+			if inContext && (oldestInContext == nil || waiter.seq < oldestInContext.seq) {
+				oldestInContext = waiter
+			}
+		}
+	}
+	target := oldestInContext
+	if target == nil && count == 1 {
+		target = only
+	}
+	if target == nil {
+		return false
+	}
+	swq.unlockedDeliver(target, msg)
+	return true
+}
+
+// CloseAll closes the channels of all pending waiters and empties the queue.
+func (swq *sendWaiterQueue) CloseAll() {
+	swq.lock.Lock()
+	defer swq.lock.Unlock()
+	for _, queue := range swq.waiters {
+		for _, waiter := range queue {
+			if waiter.cancelledAt.IsZero() {
+				close(waiter.ch)
+			}
+		}
+	}
+	clear(swq.waiters)
+}
+
+func (swq *sendWaiterQueue) unlockedDeliver(waiter *sendWaiter, msg *ircmsg.Message) {
+	swq.unlockedRemove(waiter)
+	if waiter.cancelledAt.IsZero() {
+		waiter.ch <- msg
+	}
+}
+
+func (swq *sendWaiterQueue) unlockedRemove(waiter *sendWaiter) {
+	queue := swq.waiters[waiter.key]
+	idx := slices.Index(queue, waiter)
+	if idx == -1 {
+		return
+	}
+	queue = slices.Delete(queue, idx, idx+1)
+	if len(queue) == 0 {
+		delete(swq.waiters, waiter.key)
+	} else {
+		swq.waiters[waiter.key] = queue
+	}
+}
+
+func (swq *sendWaiterQueue) unlockedPrune(key sendWaiterKey) []*sendWaiter {
+	queue := slices.DeleteFunc(swq.waiters[key], func(waiter *sendWaiter) bool {
+		return !waiter.cancelledAt.IsZero() && time.Since(waiter.cancelledAt) > cancelledWaiterTTL
+	})
+	if len(queue) == 0 {
+		delete(swq.waiters, key)
+	} else {
+		swq.waiters[key] = queue
+	}
+	return queue
+}
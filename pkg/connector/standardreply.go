@@ -0,0 +1,156 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// StandardReplyError is an IRCv3 standard reply (https://ircv3.net/specs/extensions/standard-replies).
+// Only FAIL replies are returned as errors, but WARN and NOTE replies are parsed into the same struct.
+type StandardReplyError struct {
+	Type        string
+	Command     string
+	Code        string
+	Context     []string
+	Description string
+}
+
+func parseStandardReply(msg *ircmsg.Message) *StandardReplyError {
+	if len(msg.Params) < 3 {
+		return nil
+	}
+	return &StandardReplyError{
+		Type:        msg.Command,
+		Command:     msg.Params[0],
+		Code:        msg.Params[1],
+		Context:     msg.Params[2 : len(msg.Params)-1],
+		Description: msg.Params[len(msg.Params)-1],
+	}
+}
+
+func (sre *StandardReplyError) Error() string {
+	return fmt.Sprintf("%s %s %s: %s", sre.Type, sre.Command, sre.Code, sre.Description)
+}
+
+type standardReplyMeta struct {
+	Reason  event.MessageStatusReason
+	Message string
+}
+
+var standardReplyCodes = map[string]standardReplyMeta{
+	"ACCOUNT_REQUIRED":             {event.MessageStatusNoPermission, "You must be logged into an account to do that"},
+	"NEED_REGISTRATION":            {event.MessageStatusNoPermission, "You must be logged into an account to do that"},
+	"REDACT_FORBIDDEN":             {event.MessageStatusNoPermission, "You're not allowed to delete that message"},
+	"REDACT_WINDOW_EXPIRED":        {event.MessageStatusTooOld, "The message is too old to be deleted"},
+	"UNKNOWN_MSGID":                {event.MessageStatusGenericError, "The message was not found on the server"},
+	"INVALID_TARGET":               {event.MessageStatusGenericError, "The target is not valid"},
+	"UNKNOWN_COMMAND":              {event.MessageStatusUnsupported, "The server doesn't support that command"},
+	"DISABLED":                     {event.MessageStatusUnsupported, "That feature is disabled on the server"},
+	"TEMPORARILY_UNAVAILABLE":      {event.MessageStatusNetworkError, "The server is temporarily unable to do that"},
+	"CHANNEL_NAME_IN_USE":          {event.MessageStatusGenericError, "There's already a channel with that name"},
+	"CANNOT_RENAME":                {event.MessageStatusNoPermission, "The channel can't be renamed"},
+	"ACCOUNT_EXISTS":               {event.MessageStatusGenericError, "An account with that name already exists"},
+	"BAD_ACCOUNT_NAME":             {event.MessageStatusGenericError, "That account name is not allowed"},
+	"WEAK_PASSWORD":                {event.MessageStatusGenericError, "The password is too weak"},
+	"UNACCEPTABLE_PASSWORD":        {event.MessageStatusGenericError, "That password is not allowed"},
+	"UNACCEPTABLE_EMAIL":           {event.MessageStatusGenericError, "That email address is not allowed"},
+	"INVALID_CODE":                 {event.MessageStatusGenericError, "The verification code is not valid"},
+	"ALREADY_AUTHENTICATED":        {event.MessageStatusGenericError, "You're already logged into an account"},
+	"INVALID_PARAMS":               {event.MessageStatusGenericError, "The server rejected the request parameters"},
+	"MESSAGE_ERROR":                {event.MessageStatusGenericError, "The server failed to process the message"},
+	"NEED_MORE_PARAMS":             {event.MessageStatusGenericError, "The request was missing parameters"},
+	"COMPLETE_CONNECTION_REQUIRED": {event.MessageStatusGenericError, "The connection must be fully established first"},
+}
+
+// HumanMessage returns a user-friendly description of the reply.
+func (sre *StandardReplyError) HumanMessage() string {
+	meta, ok := standardReplyCodes[sre.Code]
+	if !ok {
+		return sre.Description
+	}
+	return meta.Message
+}
+
+// As allows the error to be converted into a bridgev2.MessageStatus with errors.As.
+func (sre *StandardReplyError) As(target any) bool {
+	ms, ok := target.(*bridgev2.MessageStatus)
+	if !ok {
+		return false
+	}
+	meta, ok := standardReplyCodes[sre.Code]
+	if !ok {
+		meta.Reason = event.MessageStatusGenericError
+	}
+	status := event.MessageStatusFail
+	if meta.Reason == event.MessageStatusNetworkError {
+		status = event.MessageStatusRetriable
+	}
+	*ms = bridgev2.MessageStatus{
+		Status:      status,
+		ErrorReason: meta.Reason,
+		Message:     sre.HumanMessage(),
+		IsCertain:   true,
+		SendNotice:  true,
+	}
+	return true
+}
+
+// getChannel returns the first context parameter that looks like a channel,
+// which is used to find the portal where the reply should be sent.
+func (sre *StandardReplyError) getChannel(ic *IRCClient) string {
+	for _, param := range sre.Context {
+		if param != "" && strings.ContainsRune(ic.isupport.ChanTypes, rune(param[0])) {
+			return param
+		}
+	}
+	return ""
+}
+
+func (ic *IRCClient) onStandardReply(msg ircmsg.Message) {
+	if ic.resolveAccountRegistration(msg) {
+		return
+	}
+	reply := parseStandardReply(&msg)
+	if reply == nil {
+		return
+	}
+	ic.UserLogin.Log.Debug().
+		Str("type", reply.Type).
+		Str("command", reply.Command).
+		Str("code", reply.Code).
+		Strs("context", reply.Context).
+		Str("description", reply.Description).
+		Msg("Received standard reply")
+	var prefix string
+	switch reply.Type {
+	case "FAIL":
+		prefix = "Error"
+	case "WARN":
+		prefix = "Warning"
+	default:
+		prefix = "Note"
+	}
+	text := fmt.Sprintf("%s from server (%s): %s", prefix, format.SafeMarkdownCode(reply.Command), format.EscapeMarkdown(reply.HumanMessage()))
+	ic.sendNotice(ic.Main.Bridge.BackgroundCtx, reply.getChannel(ic), text, getTimeTag(msg))
+}
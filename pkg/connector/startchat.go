@@ -18,8 +18,13 @@ package connector
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
 	"maunium.net/go/mautrix/bridgev2"
 	"maunium.net/go/mautrix/bridgev2/networkid"
 )
@@ -27,6 +32,12 @@ import (
 var _ bridgev2.IdentifierValidatingNetwork = (*IRCConnector)(nil)
 var _ bridgev2.IdentifierResolvingNetworkAPI = (*IRCClient)(nil)
 var _ bridgev2.GhostDMCreatingNetworkAPI = (*IRCClient)(nil)
+var _ bridgev2.GroupCreatingNetworkAPI = (*IRCClient)(nil)
+
+var (
+	ErrInvalidChannelName   = errors.New("invalid channel name")
+	ErrChannelAlreadyExists = errors.New("channel already exists")
+)
 
 func (ic *IRCConnector) networkExists(name string) bool {
 	_, netExists := ic.Config.Networks[name]
@@ -50,13 +61,39 @@ func (ic *IRCClient) ResolveIdentifier(ctx context.Context, identifier string, c
 		if err != nil {
 			return nil, err
 		}
-		nick = ic.casemappedNames.GetDefault(nick, origCase)
+		if strings.HasPrefix(nick, accountIDPrefix) {
+			nick, err = ic.resolveUserID(networkid.UserID(fmt.Sprintf("%s_%s", netName, nick)))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			nick = ic.casemappedNames.GetDefault(nick, origCase)
+		}
 	} else {
 		nick = identifier
 		if !validateIdentifier(nick) {
 			return nil, fmt.Errorf("%w %s", ErrInvalidUserIDFormat, identifier)
 		}
 	}
+	err = ic.validateNick(nick)
+	if err != nil {
+		return nil, err
+	}
+	if createChat {
+		ic.addMonitorTargets(nick)
+	}
+	resp, err := ic.makeResolveIdentifierResponse(ctx, nick)
+	if err != nil {
+		return nil, err
+	}
+	resp.Chat = &bridgev2.CreateChatResponse{
+		PortalKey:  ic.makePortalKey(nick),
+		PortalInfo: ic.getDMInfo(nick),
+	}
+	return resp, nil
+}
+
+func (ic *IRCClient) makeResolveIdentifierResponse(ctx context.Context, nick string) (*bridgev2.ResolveIdentifierResponse, error) {
 	userID := ic.makeUserID(nick)
 	ghost, err := ic.Main.Bridge.GetGhostByID(ctx, userID)
 	if err != nil {
@@ -64,22 +101,130 @@ func (ic *IRCClient) ResolveIdentifier(ctx context.Context, identifier string, c
 	}
 	return &bridgev2.ResolveIdentifierResponse{
 		Ghost:    ghost,
-		UserID:   ic.makeUserID(nick),
+		UserID:   userID,
 		UserInfo: ic.getUserInfo(nick),
-		Chat: &bridgev2.CreateChatResponse{
-			PortalKey:  ic.makePortalKey(nick),
-			PortalInfo: ic.getDMInfo(nick),
-		},
 	}, nil
 }
 
 func (ic *IRCClient) CreateChatWithGhost(ctx context.Context, ghost *bridgev2.Ghost) (*bridgev2.CreateChatResponse, error) {
-	nick, err := ic.parseUserID(ghost.ID)
+	nick, err := ic.resolveUserID(ghost.ID)
 	if err != nil {
 		return nil, err
 	}
+	ic.addMonitorTargets(nick)
 	return &bridgev2.CreateChatResponse{
 		PortalKey:  ic.makePortalKey(nick),
 		PortalInfo: ic.getDMInfo(nick),
 	}, nil
 }
+
+// makeNewChannelName validates the name of a channel to create, adding the default channel prefix if necessary.
+func (ic *IRCClient) makeNewChannelName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("%w: name is empty", ErrInvalidChannelName)
+	} else if ic.isupport.ChanTypes == "" {
+		return "", fmt.Errorf("%w: the server doesn't support channels", ErrInvalidChannelName)
+	}
+	if strings.IndexByte(ic.isupport.ChanTypes, name[0]) < 0 {
+		name = ic.isupport.ChanTypes[:1] + name
+	}
+	if strings.ContainsAny(name, " ,") || strings.ContainsFunc(name, isControlChar) {
+		return "", fmt.Errorf("%w %q: contains spaces, commas or control characters", ErrInvalidChannelName, name)
+	} else if ic.isupport.ChannelLen > 0 && len(name) > ic.isupport.ChannelLen {
+		return "", fmt.Errorf("%w %q: longer than %d characters", ErrInvalidChannelName, name, ic.isupport.ChannelLen)
+	}
+	return name, nil
+}
+
+// isControlChar returns true for C0 control characters (which includes NUL, CR, LF and BEL) and DEL.
+func isControlChar(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// isInChannel returns true if the user has joined the given channel.
+func (ic *IRCClient) isInChannel(channel string) bool {
+	mappedChannel := ic.isupport.CaseMapping(channel)
+	ic.chatInfoCacheLock.RLock()
+	defer ic.chatInfoCacheLock.RUnlock()
+	for name := range ic.chatInfoCache {
+		if ic.isupport.CaseMapping(name) == mappedChannel {
+			return true
+		}
+	}
+	return false
+}
+
+// isNewChannel checks the member list received after joining a channel to find out if the channel
+// was created by the join: the user must be the only member and have been made a channel operator.
+func (ic *IRCClient) isNewChannel(members map[string]int) bool {
+	if len(members) != 1 {
+		return false
+	}
+	ownNick := ic.isupport.CaseMapping(ic.Conn.CurrentNick())
+	for nick, pl := range members {
+		return ic.isupport.CaseMapping(nick) == ownNick && pl >= modeLetterToPowerLevel('o')
+	}
+	return false
+}
+
+func (ic *IRCClient) CreateGroup(ctx context.Context, params *bridgev2.GroupCreateParams) (*bridgev2.CreateChatResponse, error) {
+	if !ic.IsLoggedIn() {
+		return nil, bridgev2.ErrNotLoggedIn
+	}
+	channel, err := ic.makeNewChannelName(ptr.Val(params.Name).Name)
+	if err != nil {
+		return nil, err
+	}
+	var topic string
+	if params.Topic != nil {
+		topic = ic.encodeText(channel, params.Topic.Topic)
+		if ic.isupport.TopicLen > 0 && len(topic) > ic.isupport.TopicLen {
+			return nil, makeTooLongError("topic", len(topic), ic.isupport.TopicLen)
+		}
+	}
+	log := zerolog.Ctx(ctx).With().Str("channel", channel).Logger()
+	res, err := ic.JoinChannel(ctx, channel)
+	if errors.Is(err, ErrAlreadyInChannel) {
+		return nil, fmt.Errorf("%w: %s", ErrChannelAlreadyExists, channel)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to join channel: %w", err)
+	} else if !ic.isNewChannel(res.Members) {
+		err = ic.Conn.Part(channel)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to leave existing channel")
+		}
+		return nil, fmt.Errorf("%w: %s", ErrChannelAlreadyExists, channel)
+	}
+	// The rest of the setup is best-effort, as the channel exists once it's joined
+	if modes := strings.Fields(ic.NetMeta.NewChannelModes); len(modes) > 0 {
+		err = ic.sendModeChanges(ctx, channel, ic.isupport.parseModeChanges(modes[0], modes[1:]))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to set initial channel modes")
+		}
+	}
+	if topic != "" {
+		_, err = ic.SendRequest(ctx, nil, "", "TOPIC", channel, topic)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to set initial channel topic")
+		}
+	}
+	if ic.NetMeta.RegisterChannels {
+		_, err = ic.SendRequest(ctx, nil, "", "PRIVMSG", "chanserv", "REGISTER "+channel)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to register channel with ChanServ")
+		}
+	}
+	meta := ic.UserLogin.Metadata.(*UserLoginMetadata)
+	if !slices.Contains(meta.Channels, channel) {
+		meta.Channels = append(meta.Channels, channel)
+		err = ic.UserLogin.Save(ctx)
+		if err != nil {
+			log.Err(err).Msg("Failed to save login after adding autojoin channel")
+		}
+	}
+	return &bridgev2.CreateChatResponse{
+		PortalKey:  ic.makePortalKey(channel),
+		PortalInfo: ic.getChannelInfo(channel),
+	}, nil
+}
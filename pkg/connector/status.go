@@ -0,0 +1,220 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/rs/zerolog"
+	"go.mau.fi/util/ptr"
+	"maunium.net/go/mautrix/bridgev2"
+	"maunium.net/go/mautrix/bridgev2/database"
+	"maunium.net/go/mautrix/bridgev2/networkid"
+	"maunium.net/go/mautrix/bridgev2/simplevent"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-irc/pkg/ircfmt"
+)
+
+// statusChannel is the pseudo-channel name of the status portal, which contains server messages
+// and works like the server window of traditional IRC clients. Real channels and nicks can't be *.
+const statusChannel = "*"
+
+// ErrStatusRoomUnsupported is returned for Matrix events that can't be bridged in the status room,
+// as only raw commands can be sent there.
+var ErrStatusRoomUnsupported = bridgev2.WrapErrorInStatus(errors.New("only text messages can be sent in the status room")).
+	WithIsCertain(true).WithErrorAsMessage().WithErrorReason(event.MessageStatusUnsupported)
+
+// statusRoomFeatures are the room features of the status room, which only accepts raw commands as text.
+var statusRoomFeatures = &event.RoomFeatures{
+	ID:            capIDPrefix + "+status",
+	MaxTextLength: 510,
+	Reply:         event.CapLevelRejected,
+	Reaction:      event.CapLevelRejected,
+	Delete:        event.CapLevelRejected,
+}
+
+// statusIgnoredNumerics are numerics that the bridge handles itself, so they aren't shown in the status room.
+var statusIgnoredNumerics = map[string]struct{}{
+	ircevent.RPL_WELCOME: {}, ircevent.RPL_YOURHOST: {}, ircevent.RPL_CREATED: {},
+	ircevent.RPL_MYINFO: {}, ircevent.RPL_ISUPPORT: {},
+	ircevent.RPL_MOTDSTART: {}, ircevent.RPL_MOTD: {}, ircevent.RPL_ENDOFMOTD: {}, ircevent.ERR_NOMOTD: {},
+	ircevent.RPL_NAMREPLY: {}, ircevent.RPL_ENDOFNAMES: {},
+	ircevent.RPL_TOPIC: {}, ircevent.RPL_TOPICTIME: {},
+	ircevent.RPL_UNAWAY: {}, ircevent.RPL_NOWAWAY: {},
+	ircevent.RPL_WHOREPLY: {}, ircevent.RPL_WHOSPCRPL: {}, ircevent.RPL_ENDOFWHO: {}, ircevent.RPL_ENDOFWHOIS: {},
+	ircevent.RPL_MONONLINE: {}, ircevent.RPL_MONOFFLINE: {}, ircevent.ERR_MONLISTFULL: {}, ircevent.RPL_ISON: {},
+	"321": {}, ircevent.RPL_LIST: {}, ircevent.RPL_LISTEND: {},
+	ircevent.ERR_LINKCHANNEL: {},
+}
+
+// statusWhoisNumerics are the WHOIS replies which are hidden from the status room
+// if they're a response to a user info query made by the bridge.
+var statusWhoisNumerics = map[string]struct{}{
+	ircevent.RPL_WHOISUSER: {}, ircevent.RPL_WHOISSERVER: {}, ircevent.RPL_WHOISOPERATOR: {},
+	ircevent.RPL_WHOISIDLE: {}, ircevent.RPL_WHOISCHANNELS: {}, ircevent.RPL_WHOISACCOUNT: {},
+	ircevent.RPL_WHOISACTUALLY: {}, ircevent.RPL_WHOISCERTFP: {}, ircevent.RPL_WHOISMODES: {},
+	ircevent.RPL_WHOISSECURE: {}, ircevent.RPL_AWAY: {}, ircevent.RPL_WHOISBOT: {},
+}
+
+func init() {
+	for _, numeric := range joinErrorNumerics {
+		statusIgnoredNumerics[numeric] = struct{}{}
+	}
+}
+
+func (ic *IRCClient) getStatusInfo() *bridgev2.ChatInfo {
+	info := &bridgev2.ChatInfo{
+		Name:  ptr.Ptr(fmt.Sprintf("%s status", ic.NetMeta.DisplayName)),
+		Topic: ptr.Ptr("Server messages. Anything sent here is sent to the server as a raw IRC command."),
+		Members: &bridgev2.ChatMemberList{
+			IsFull:                     true,
+			ExcludeChangesFromTimeline: true,
+			MemberMap:                  bridgev2.ChatMemberMap{},
+		},
+		Type: ptr.Ptr(database.RoomTypeDefault),
+	}
+	info.Members.MemberMap.Set(bridgev2.ChatMember{
+		EventSender: bridgev2.EventSender{IsFromMe: true, SenderLogin: ic.UserLogin.ID},
+	})
+	if ic.NetMeta.AvatarURL != "" {
+		info.Avatar = &bridgev2.Avatar{
+			ID:  networkid.AvatarID(ic.NetMeta.AvatarURL),
+			MXC: ic.NetMeta.AvatarURL,
+		}
+	}
+	return info
+}
+
+func (ic *IRCClient) makeStatusMessageID(msg ircmsg.Message) networkid.MessageID {
+	if ok, msgID := msg.GetTag("msgid"); ok {
+		return makeProperMessageID(ic.NetMeta.Name, msgID)
+	}
+	return ic.makeLocalMessageID()
+}
+
+// sendStatusMessage queues a message from the bridge bot into the status portal, creating it if necessary.
+func (ic *IRCClient) sendStatusMessage(msg ircmsg.Message, content *event.MessageEventContent) {
+	content.Mentions = &event.Mentions{}
+	ic.UserLogin.QueueRemoteEvent(&simplevent.Message[*event.MessageEventContent]{
+		EventMeta: simplevent.EventMeta{
+			Type: bridgev2.RemoteEventMessage,
+			LogContext: func(c zerolog.Context) zerolog.Context {
+				return c.Str("source", msg.Source).Str("command", msg.Command)
+			},
+			PortalKey:    ic.makePortalKey(statusChannel),
+			CreatePortal: true,
+			Timestamp:    getTimeTag(msg),
+		},
+		Data: content,
+		ID:   ic.makeStatusMessageID(msg),
+		ConvertMessageFunc: func(
+			ctx context.Context, portal *bridgev2.Portal, intent bridgev2.MatrixAPI, content *event.MessageEventContent,
+		) (*bridgev2.ConvertedMessage, error) {
+			return &bridgev2.ConvertedMessage{
+				Parts: []*bridgev2.ConvertedMessagePart{{
+					Type:    event.EventMessage,
+					Content: content,
+				}},
+			}, nil
+		},
+	})
+}
+
+// onStatusMessage forwards server notices and messages that aren't from a normal user to the status room.
+func (ic *IRCClient) onStatusMessage(msg ircmsg.Message) {
+	if len(msg.Params) < 2 {
+		return
+	}
+	content := ircfmt.ASCIIToContent(msg.Params[1])
+	if msg.Command == "NOTICE" {
+		content.MsgType = event.MsgNotice
+	}
+	if nick := msg.Nick(); nick != "" && !strings.ContainsRune(nick, '.') {
+		content = ircfmt.ASCIIToContent(fmt.Sprintf("<%s> %s", nick, msg.Params[1]))
+		content.MsgType = event.MsgNotice
+	}
+	ic.sendStatusMessage(msg, content)
+}
+
+// onStatusNumeric is a global callback that forwards numerics the bridge doesn't handle to the status room.
+// Numerics that are being collected as the reply to a raw command are left out.
+func (ic *IRCClient) onStatusNumeric(msg ircmsg.Message) bool {
+	if len(msg.Command) != 3 || msg.Command[0] < '0' || msg.Command[0] > '9' || len(msg.Params) < 2 {
+		return false
+	} else if _, ignored := statusIgnoredNumerics[msg.Command]; ignored {
+		return false
+	} else if _, isWhois := statusWhoisNumerics[msg.Command]; isWhois && ic.hasUserQueryWaiter(msg.Params[1]) {
+		return false
+	} else if ic.wasRawReply() {
+		// Replies to the raw command are shown to the user as the command response
+		return false
+	}
+	content := ircfmt.ASCIIToContent(strings.Join(msg.Params[1:], " "))
+	content.MsgType = event.MsgNotice
+	ic.sendStatusMessage(msg, content)
+	return false
+}
+
+func (ic *IRCClient) onWallops(msg ircmsg.Message) {
+	if len(msg.Params) < 1 {
+		return
+	}
+	content := ircfmt.ASCIIToContent(fmt.Sprintf("WALLOPS from %s: %s", msg.Nick(), msg.Params[0]))
+	content.MsgType = event.MsgNotice
+	ic.sendStatusMessage(msg, content)
+}
+
+// handleStatusInput sends messages from the status room to the server as raw IRC commands, one per line.
+func (ic *IRCClient) handleStatusInput(ctx context.Context, msg *bridgev2.MatrixMessage) (*bridgev2.MatrixMessageResponse, error) {
+	if msg.Content.MsgType != event.MsgText && msg.Content.MsgType != event.MsgNotice {
+		return nil, ErrStatusRoomUnsupported
+	}
+	var lines []ircmsg.Message
+	for line := range strings.SplitSeq(msg.Content.Body, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "/")
+		if line == "" {
+			continue
+		}
+		parsed, err := ircmsg.ParseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse command %q: %w", line, err)
+		}
+		parsed.Command = strings.ToUpper(parsed.Command)
+		lines = append(lines, parsed)
+	}
+	for _, line := range lines {
+		err := ic.Conn.SendIRCMessage(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+	zerolog.Ctx(ctx).Debug().Int("line_count", len(lines)).Msg("Sent raw commands from status room")
+	return &bridgev2.MatrixMessageResponse{
+		DB: &database.Message{
+			ID:        ic.makeLocalMessageID(),
+			SenderID:  ic.makeUserID(ic.Conn.CurrentNick()),
+			Timestamp: time.Now(),
+		},
+	}, nil
+}
@@ -0,0 +1,436 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/bridgev2/database"
+)
+
+// ircUser contains the information the bridge has seen about an IRC user.
+type ircUser struct {
+	User     string
+	Host     string
+	RealName string
+	Account  string
+
+	Away        bool
+	AwayMessage string
+	// Bot is true if the user has the bot mode set.
+	Bot bool
+}
+
+// whoxToken is the token used in WHOX queries sent by the bridge to recognize the replies.
+const whoxToken = "137"
+
+// whoxFields are the fields requested in WHOX queries. The replies contain them in the order defined
+// by the spec (token, user, host, nick, flags, account, realname) rather than the order in the query.
+const whoxFields = "%tuhnfar"
+
+func (ic *IRCClient) getUser(nick string) (ircUser, bool) {
+	ic.usersLock.RLock()
+	defer ic.usersLock.RUnlock()
+	user, ok := ic.users[ic.isupport.CaseMapping(nick)]
+	if !ok {
+		return ircUser{}, false
+	}
+	return *user, true
+}
+
+// updateUser calls the given function with the stored info of the user, creating it if necessary.
+// The function should return true if it changed anything.
+func (ic *IRCClient) updateUser(nick string, fn func(user *ircUser) bool) bool {
+	nick = ic.isupport.CaseMapping(nick)
+	ic.usersLock.Lock()
+	defer ic.usersLock.Unlock()
+	user, ok := ic.users[nick]
+	if !ok {
+		user = &ircUser{}
+		ic.users[nick] = user
+	}
+	return fn(user)
+}
+
+// moveUser moves the stored info of a user who changed their nick and returns it.
+func (ic *IRCClient) moveUser(prevNick, newNick string) ircUser {
+	prevNick = ic.isupport.CaseMapping(prevNick)
+	newNick = ic.isupport.CaseMapping(newNick)
+	ic.usersLock.Lock()
+	defer ic.usersLock.Unlock()
+	user, ok := ic.users[prevNick]
+	delete(ic.users, prevNick)
+	if !ok {
+		delete(ic.users, newNick)
+		return ircUser{}
+	}
+	ic.users[newNick] = user
+	return *user
+}
+
+func (ic *IRCClient) removeUser(nick string) {
+	ic.usersLock.Lock()
+	delete(ic.users, ic.isupport.CaseMapping(nick))
+	ic.usersLock.Unlock()
+}
+
+// pruneUser removes the stored info of a user if the bridge no longer shares any channel with them
+// and they aren't a DM contact, as nothing would keep the info up to date anymore.
+func (ic *IRCClient) pruneUser(nick string) {
+	if !ic.isInSharedChannel(nick) && !ic.isMonitored(nick) {
+		ic.removeUser(nick)
+	}
+}
+
+// shouldTrackUser returns true if the info of the sender of the message should be stored. Info is only
+// stored for users that the bridge shares a channel with, DM contacts and users who are joining a channel,
+// so that the user map doesn't fill up with everyone who happens to send something.
+func (ic *IRCClient) shouldTrackUser(nick string, msg ircmsg.Message) bool {
+	switch msg.Command {
+	case "JOIN":
+		return true
+	case "PRIVMSG", "NOTICE", "TAGMSG", "CTCP_ACTION":
+		if len(msg.Params) > 0 && !isChannelName(msg.Params[0], ic.isupport) {
+			// DM senders are added as monitor targets right after this
+			return true
+		}
+	}
+	if _, ok := ic.getUser(nick); ok {
+		return true
+	}
+	return ic.isInSharedChannel(nick) || ic.isMonitored(nick)
+}
+
+func (ic *IRCClient) clearUsers() {
+	ic.usersLock.Lock()
+	clear(ic.users)
+	ic.usersLock.Unlock()
+}
+
+// isInSharedChannel returns true if the user is in any channel the bridge has members for,
+// which means the bridge will be told about changes to the user's info.
+func (ic *IRCClient) isInSharedChannel(nick string) bool {
+	ic.chatInfoCacheLock.RLock()
+	defer ic.chatInfoCacheLock.RUnlock()
+	for range ic.unlockedFindChannelsOfMember(nick) {
+		return true
+	}
+	return false
+}
+
+// onUserInfo is a global callback that records info about users from message sources, tags and
+// user info commands/numerics before the actual handlers run. It never consumes the message.
+func (ic *IRCClient) onUserInfo(msg ircmsg.Message) bool {
+	switch msg.Command {
+	case ircevent.RPL_WHOISUSER:
+		// <client> <nick> <username> <host> * :<realname>
+		if len(msg.Params) >= 6 {
+			ic.updateUser(msg.Params[1], func(user *ircUser) bool {
+				user.User, user.Host, user.RealName = msg.Params[2], msg.Params[3], msg.Params[5]
+				// RPL_WHOISBOT comes after this if the user is a bot
+				user.Bot = false
+				return true
+			})
+		}
+		return false
+	case ircevent.RPL_WHOISBOT:
+		// <client> <nick> :is a bot
+		if len(msg.Params) >= 2 {
+			ic.updateUser(msg.Params[1], func(user *ircUser) bool {
+				user.Bot = true
+				return true
+			})
+		}
+		return false
+	case ircevent.RPL_WHOISACCOUNT:
+		// <client> <nick> <account> :is logged in as
+		if len(msg.Params) >= 3 {
+			ic.updateAccount(msg, msg.Params[1], msg.Params[2])
+		}
+		return false
+	case ircevent.RPL_AWAY:
+		// <client> <nick> :<message>
+		if len(msg.Params) >= 3 {
+			ic.setAway(msg.Params[1], true, msg.Params[2])
+		}
+		return false
+	case ircevent.RPL_WHOREPLY:
+		// <client> <channel> <username> <host> <server> <nick> <flags> :<hopcount> <realname>
+		if len(msg.Params) >= 8 {
+			_, realName, _ := strings.Cut(msg.Params[7], " ")
+			ic.updateUser(msg.Params[5], func(user *ircUser) bool {
+				user.User, user.Host, user.RealName = msg.Params[2], msg.Params[3], realName
+				user.Bot = ic.hasBotFlag(msg.Params[6])
+				return true
+			})
+			ic.addWhoSearchResult(msg.Params[5])
+		}
+		return false
+	case ircevent.RPL_WHOSPCRPL:
+		ic.onWHOXReply(msg)
+		return false
+	case ircevent.RPL_ENDOFWHOIS, ircevent.RPL_ENDOFWHO, ircevent.ERR_NOSUCHNICK:
+		if len(msg.Params) >= 2 {
+			ic.resolveUserQueryWaiter(msg.Params[1])
+		}
+		return false
+	}
+	nick := msg.Nick()
+	if nick == "" || !strings.ContainsRune(msg.Source, '!') {
+		return false
+	} else if msg.Command == "QUIT" {
+		ic.setOnline(nick, false)
+		return false
+	}
+	if !ic.shouldTrackUser(nick, msg) {
+		return false
+	}
+	nuh, _ := msg.NUH()
+	ic.updateUser(nick, func(user *ircUser) bool {
+		changed := user.User != nuh.User || user.Host != nuh.Host
+		user.User, user.Host = nuh.User, nuh.Host
+		return changed
+	})
+	if msg.Command != "NICK" {
+		ic.setOnline(nick, true)
+	}
+	switch msg.Command {
+	case "NICK":
+		// The rest is handled in onNick, as the previous ghost ID needs to be known
+		ic.setOnline(nick, false)
+		if len(msg.Params) >= 1 {
+			ic.setOnline(msg.Params[0], true)
+		}
+		return false
+	case "CHGHOST":
+		// CHGHOST <new_user> <new_host>
+		if len(msg.Params) >= 2 {
+			ic.updateUser(nick, func(user *ircUser) bool {
+				user.User, user.Host = msg.Params[0], msg.Params[1]
+				return true
+			})
+			ic.updateGhostProfile(nick)
+		}
+	case "SETNAME":
+		if len(msg.Params) >= 1 {
+			ic.updateUser(nick, func(user *ircUser) bool {
+				user.RealName = msg.Params[0]
+				return true
+			})
+			ic.updateGhostProfile(nick)
+		}
+	case "AWAY":
+		// away-notify: AWAY [:message], no message means the user is back
+		if len(msg.Params) >= 1 && msg.Params[0] != "" {
+			ic.setAway(nick, true, msg.Params[0])
+		} else {
+			ic.setAway(nick, false, "")
+		}
+	case "ACCOUNT":
+		if len(msg.Params) >= 1 {
+			ic.updateAccount(msg, nick, msg.Params[0])
+		}
+		return false
+	case "JOIN":
+		if len(msg.Params) >= 3 {
+			// extended-join: JOIN <channel> <account> :<realname>
+			ic.updateUser(nick, func(user *ircUser) bool {
+				user.RealName = msg.Params[2]
+				return true
+			})
+			ic.updateAccount(msg, nick, msg.Params[1])
+			return false
+		}
+	}
+	if _, ok := ic.Conn.AcknowledgedCaps()["account-tag"]; ok {
+		_, account := msg.GetTag("account")
+		ic.updateAccount(msg, nick, account)
+	}
+	return false
+}
+
+func (ic *IRCClient) onWHOXReply(msg ircmsg.Message) {
+	// <client> <token> <user> <host> <nick> <flags> <account> :<realname>
+	if len(msg.Params) < 8 || (msg.Params[1] != whoxToken && msg.Params[1] != whoSearchToken) {
+		return
+	}
+	nick, flags, account := msg.Params[4], msg.Params[5], msg.Params[6]
+	if msg.Params[1] == whoSearchToken {
+		ic.addWhoSearchResult(nick)
+	}
+	if account == "0" {
+		account = ""
+	}
+	awayChanged := ic.updateUser(nick, func(user *ircUser) bool {
+		user.User, user.Host, user.RealName = msg.Params[2], msg.Params[3], msg.Params[7]
+		user.Bot = ic.hasBotFlag(flags)
+		away := strings.HasPrefix(flags, "G")
+		if away == user.Away {
+			return false
+		}
+		// WHO doesn't include the away message
+		user.Away, user.AwayMessage = away, ""
+		return true
+	})
+	ic.updateAccount(msg, nick, account)
+	if awayChanged {
+		ic.updateGhostPresence(nick)
+	}
+}
+
+// hasBotFlag returns true if the flags in a WHO reply contain the bot mode letter from ISUPPORT.
+func (ic *IRCClient) hasBotFlag(flags string) bool {
+	return ic.isupport.Bot != "" && strings.Contains(flags, ic.isupport.Bot)
+}
+
+// setAway stores the away status of a user and updates the ghost's presence if it changed.
+func (ic *IRCClient) setAway(nick string, away bool, message string) {
+	changed := ic.updateUser(nick, func(user *ircUser) bool {
+		changed := user.Away != away || user.AwayMessage != message
+		user.Away, user.AwayMessage = away, message
+		return changed
+	})
+	if changed {
+		ic.updateGhostPresence(nick)
+	}
+}
+
+// updateGhostProfile pushes the stored info of a user to their ghost if the ghost already exists.
+func (ic *IRCClient) updateGhostProfile(nick string) {
+	userID := ic.makeUserID(nick)
+	info := ic.getUserInfo(nick)
+	go func() {
+		log := ic.UserLogin.Log.With().
+			Str("action", "update ghost profile").
+			Str("ghost_id", string(userID)).
+			Logger()
+		ctx := log.WithContext(ic.Main.Bridge.BackgroundCtx)
+		ghost, err := ic.Main.Bridge.GetExistingGhostByID(ctx, userID)
+		if err != nil {
+			log.Err(err).Msg("Failed to get ghost")
+		} else if ghost != nil {
+			ghost.UpdateInfo(ctx, info)
+		}
+	}()
+}
+
+// makeExtraProfile returns the IRC-specific profile fields of a user.
+func makeExtraProfile(user ircUser) database.ExtraProfile {
+	var profile database.ExtraProfile
+	if user.User != "" {
+		profile.With("fi.mau.irc.username", user.User).With("fi.mau.irc.hostname", user.Host)
+	}
+	if user.RealName != "" {
+		profile.With("fi.mau.irc.realname", user.RealName)
+	}
+	if user.Account != "" {
+		profile.With("fi.mau.irc.account", user.Account)
+	}
+	if user.Away {
+		profile.With("fi.mau.irc.away", user.AwayMessage)
+	} else if profile != nil {
+		profile.With("fi.mau.irc.away", nil)
+	}
+	return profile
+}
+
+func (ic *IRCClient) addUserQueryWaiter(nick string) <-chan struct{} {
+	nick = ic.isupport.CaseMapping(nick)
+	ic.userQueryWaitersLock.Lock()
+	defer ic.userQueryWaitersLock.Unlock()
+	ch, ok := ic.userQueryWaiters[nick]
+	if !ok {
+		ch = make(chan struct{})
+		ic.userQueryWaiters[nick] = ch
+	}
+	return ch
+}
+
+func (ic *IRCClient) hasUserQueryWaiter(nick string) bool {
+	nick = ic.isupport.CaseMapping(nick)
+	ic.userQueryWaitersLock.Lock()
+	defer ic.userQueryWaitersLock.Unlock()
+	_, ok := ic.userQueryWaiters[nick]
+	return ok
+}
+
+func (ic *IRCClient) resolveUserQueryWaiter(nick string) {
+	nick = ic.isupport.CaseMapping(nick)
+	ic.userQueryWaitersLock.Lock()
+	defer ic.userQueryWaitersLock.Unlock()
+	ch, ok := ic.userQueryWaiters[nick]
+	if ok {
+		close(ch)
+		delete(ic.userQueryWaiters, nick)
+	}
+}
+
+// handleLabeledUserInfo passes the replies in a labeled response to onUserInfo,
+// as labeled responses don't go through the normal callbacks.
+func (ic *IRCClient) handleLabeledUserInfo(resp *ircevent.Batch) {
+	for _, msg := range flattenBatch(resp, nil) {
+		ic.onUserInfo(msg)
+	}
+}
+
+// queryUser sends a WHOX query (or WHOIS if WHOX isn't supported) for the given nick and waits for
+// the replies to be stored in the user info cache.
+func (ic *IRCClient) queryUser(ctx context.Context, nick string) error {
+	cmd, args := "WHOIS", []string{nick}
+	if ic.isupport.WHOX {
+		cmd, args = "WHO", []string{nick, fmt.Sprintf("%s,%s", whoxFields, whoxToken)}
+	}
+	resp, err := ic.getLabeledResponse(ctx, nil, cmd, args...)
+	if err == nil {
+		ic.handleLabeledUserInfo(resp)
+		return nil
+	} else if !errors.Is(err, ircevent.CapabilityNotNegotiated) {
+		return err
+	}
+	waiter := ic.addUserQueryWaiter(nick)
+	err = ic.Conn.Send(cmd, args...)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-waiter:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchUserInfo queries the server for info about the user if the bridge doesn't have
+// up-to-date info, i.e. if the user isn't in any channel that the bridge is in.
+func (ic *IRCClient) fetchUserInfo(ctx context.Context, nick string) {
+	if ic.isInSharedChannel(nick) || !ic.IsLoggedIn() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err := ic.queryUser(ctx, nick)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("nick", nick).Msg("Failed to query user info")
+	}
+}
@@ -0,0 +1,179 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ergochat/irc-go/ircevent"
+	"github.com/ergochat/irc-go/ircmsg"
+	"maunium.net/go/mautrix/format"
+
+	"go.mau.fi/mautrix-irc/pkg/ircfmt"
+)
+
+// whoisInfo contains the parsed replies to a WHOIS command.
+type whoisInfo struct {
+	Nick       string
+	User       string
+	Host       string
+	RealName   string
+	Server     string
+	ServerInfo string
+	Account    string
+	Operator   string
+	Idle       time.Duration
+	SignOn     time.Time
+	Channels   []string
+	Secure     bool
+	Away       string
+	// Extra contains the text of replies that don't have a dedicated field, like the actual host or user modes.
+	Extra []string
+}
+
+// parseWhoisReplies collects the WHOIS numerics into a whoisInfo. Numerics about other nicks are ignored.
+func (ic *IRCClient) parseWhoisReplies(nick string, msgs []ircmsg.Message) (*whoisInfo, error) {
+	info := &whoisInfo{Nick: nick}
+	found := false
+	for _, msg := range msgs {
+		if msg.Command == "FAIL" {
+			return nil, makeStandardReplyError(&msg)
+		} else if len(msg.Params) < 3 || ic.isupport.CaseMapping(msg.Params[1]) != ic.isupport.CaseMapping(nick) {
+			continue
+		}
+		text := msg.Params[len(msg.Params)-1]
+		switch msg.Command {
+		case ircevent.ERR_NOSUCHNICK, ircevent.ERR_NOSUCHSERVER:
+			return nil, &IRCError{Msg: &msg}
+		case ircevent.RPL_WHOISUSER:
+			// <client> <nick> <username> <host> * :<realname>
+			if len(msg.Params) >= 6 {
+				info.Nick, info.User, info.Host, info.RealName = msg.Params[1], msg.Params[2], msg.Params[3], msg.Params[5]
+			}
+		case ircevent.RPL_WHOISSERVER:
+			// <client> <nick> <server> :<server info>
+			if len(msg.Params) >= 4 {
+				info.Server, info.ServerInfo = msg.Params[2], msg.Params[3]
+			}
+		case ircevent.RPL_WHOISOPERATOR:
+			info.Operator = text
+		case ircevent.RPL_WHOISIDLE:
+			// <client> <nick> <secs> [<signon>] :seconds idle, signon time
+			if idle, err := strconv.Atoi(msg.Params[2]); err == nil {
+				info.Idle = time.Duration(idle) * time.Second
+			}
+			if len(msg.Params) >= 5 {
+				if signOn, err := strconv.ParseInt(msg.Params[3], 10, 64); err == nil {
+					info.SignOn = time.Unix(signOn, 0)
+				}
+			}
+		case ircevent.RPL_WHOISCHANNELS:
+			info.Channels = append(info.Channels, strings.Fields(text)...)
+		case ircevent.RPL_WHOISACCOUNT:
+			// <client> <nick> <account> :is logged in as
+			info.Account = msg.Params[2]
+		case ircevent.RPL_WHOISSECURE:
+			info.Secure = true
+		case ircevent.RPL_AWAY:
+			info.Away = text
+		case ircevent.RPL_ENDOFWHOIS:
+			continue
+		default:
+			info.Extra = append(info.Extra, strings.Join(msg.Params[2:], " "))
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no WHOIS reply received")
+	}
+	return info, nil
+}
+
+// Whois sends a WHOIS query for the given nick and returns the parsed replies.
+// The replies are also used to refresh the info of the user's ghost.
+func (ic *IRCClient) Whois(ctx context.Context, nick string) (*whoisInfo, error) {
+	msgs, err := ic.SendRawRequest(ctx, nil, "WHOIS", nick)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ic.Conn.AcknowledgedCaps()["labeled-response"]; ok {
+		// Labeled responses don't go through the normal callbacks, so pass the replies manually
+		for _, msg := range msgs {
+			ic.onUserInfo(msg)
+		}
+	}
+	info, err := ic.parseWhoisReplies(nick, msgs)
+	if err != nil {
+		return nil, err
+	}
+	if info.Away == "" {
+		ic.setAway(info.Nick, false, "")
+	}
+	ic.updateGhostProfile(info.Nick)
+	return info, nil
+}
+
+// Format renders the WHOIS info as a markdown list.
+func (wi *whoisInfo) Format() string {
+	var buf strings.Builder
+	code := format.SafeMarkdownCode[string]
+	_, _ = fmt.Fprintf(&buf, "**%s**", format.EscapeMarkdown(wi.Nick))
+	if wi.User != "" {
+		_, _ = fmt.Fprintf(&buf, " (%s)", code(fmt.Sprintf("%s@%s", wi.User, wi.Host)))
+	}
+	if wi.RealName != "" {
+		_, _ = fmt.Fprintf(&buf, "\n* Real name: %s", format.EscapeMarkdown(ircfmt.StripASCII(wi.RealName)))
+	}
+	if wi.Account != "" {
+		_, _ = fmt.Fprintf(&buf, "\n* Logged in as %s", code(wi.Account))
+	} else {
+		buf.WriteString("\n* Not logged in")
+	}
+	if wi.Server != "" {
+		_, _ = fmt.Fprintf(&buf, "\n* Connected to %s (%s)", code(wi.Server), format.EscapeMarkdown(wi.ServerInfo))
+	}
+	if wi.Secure {
+		buf.WriteString("\n* Using a secure connection")
+	}
+	if wi.Operator != "" {
+		_, _ = fmt.Fprintf(&buf, "\n* %s", format.EscapeMarkdown(wi.Operator))
+	}
+	if len(wi.Channels) > 0 {
+		channels := make([]string, len(wi.Channels))
+		for i, channel := range wi.Channels {
+			channels[i] = code(channel)
+		}
+		_, _ = fmt.Fprintf(&buf, "\n* Channels: %s", strings.Join(channels, ", "))
+	}
+	if wi.Away != "" {
+		_, _ = fmt.Fprintf(&buf, "\n* Away: %s", format.EscapeMarkdown(ircfmt.StripASCII(wi.Away)))
+	}
+	if wi.Idle > 0 || !wi.SignOn.IsZero() {
+		_, _ = fmt.Fprintf(&buf, "\n* Idle for %s", wi.Idle)
+		if !wi.SignOn.IsZero() {
+			_, _ = fmt.Fprintf(&buf, ", signed on at %s", wi.SignOn.UTC().Format(time.DateTime+" MST"))
+		}
+	}
+	for _, extra := range wi.Extra {
+		_, _ = fmt.Fprintf(&buf, "\n* %s", format.EscapeMarkdown(ircfmt.StripASCII(extra)))
+	}
+	return buf.String()
+}
@@ -0,0 +1,77 @@
+// mautrix-irc - A Matrix-IRC puppeting bridge.
+// Copyright (C) 2025 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package connector
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ergochat/irc-go/ircmsg"
+)
+
+func parseLines(t *testing.T, lines ...string) []ircmsg.Message {
+	t.Helper()
+	msgs := make([]ircmsg.Message, len(lines))
+	for i, line := range lines {
+		var err error
+		msgs[i], err = ircmsg.ParseLine(line)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", line, err)
+		}
+	}
+	return msgs
+}
+
+func TestParseWhoisReplies(t *testing.T) {
+	ic := &IRCClient{isupport: defaultISupport}
+	info, err := ic.parseWhoisReplies("alice", parseLines(t,
+		":irc.example.com 311 me Alice alice example.com * :Alice Example",
+		":irc.example.com 312 me Alice irc.example.com :Example server",
+		":irc.example.com 319 me Alice :@#chan +#other",
+		":irc.example.com 317 me Alice 120 1700000000 :seconds idle, signon time",
+		":irc.example.com 330 me Alice alice_acc :is logged in as",
+		":irc.example.com 671 me Alice :is using a secure connection",
+		":irc.example.com 311 me bob bob example.com * :Bob",
+		":irc.example.com 318 me Alice :End of /WHOIS list.",
+	))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Nick != "Alice" || info.User != "alice" || info.Host != "example.com" || info.RealName != "Alice Example" {
+		t.Errorf("Unexpected user info: %+v", info)
+	}
+	if info.Account != "alice_acc" || !info.Secure || info.Server != "irc.example.com" {
+		t.Errorf("Unexpected account/server info: %+v", info)
+	}
+	if info.Idle != 2*time.Minute || info.SignOn.Unix() != 1700000000 {
+		t.Errorf("Unexpected idle info: %s / %s", info.Idle, info.SignOn)
+	}
+	if !slices.Equal(info.Channels, []string{"@#chan", "+#other"}) {
+		t.Errorf("Unexpected channels: %q", info.Channels)
+	}
+
+	_, err = ic.parseWhoisReplies("nobody", parseLines(t,
+		":irc.example.com 401 me nobody :No such nick/channel",
+		":irc.example.com 318 me nobody :End of /WHOIS list.",
+	))
+	var ircErr *IRCError
+	if !errors.As(err, &ircErr) {
+		t.Errorf("Expected IRC error for unknown nick, got %v", err)
+	}
+}